@@ -2,18 +2,17 @@ package main
 
 import (
 	"context"
-	"github.com/ghodss/yaml"
 	"github.com/kamijin-fanta/envoy-acme/pkg/acme_service"
-	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/dns01_service"
+	"github.com/kamijin-fanta/envoy-acme/pkg/http01_service"
+	"github.com/kamijin-fanta/envoy-acme/pkg/sites_config"
 	"github.com/kamijin-fanta/envoy-acme/pkg/xds_service"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/xid"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
-	"io/ioutil"
 	"net"
 	"net/http"
-	"os"
 )
 
 func CmdStart(c *cli.Context) error {
@@ -29,34 +28,46 @@ func CmdStart(c *cli.Context) error {
 	}
 
 	config := &acme_service.AcmeProcessConfig{
-		CaDir:       c.String("ca-dir"),
-		RemainDays:  c.Int("cert-days"),
-		Interval:    c.Duration("interval"),
-		LockTimeout: c.Duration("lock-timeout"),
-		InstanceId:  xid.New().String(),
+		CaDir:                  c.String("ca-dir"),
+		RemainDays:             c.Int("cert-days"),
+		Interval:               c.Duration("interval"),
+		LockTimeout:            c.Duration("lock-timeout"),
+		InstanceId:             xid.New().String(),
+		ChallengeWatchInterval: c.Duration("challenge-watch-interval"),
+		Workers:                c.Int("workers"),
+		BackoffBase:            c.Duration("backoff-base"),
+		BackoffMax:             c.Duration("backoff-max"),
+		OcspInterval:           c.Duration("ocsp-interval"),
+		OcspResponderFailure:   c.String("ocsp-responder-failure"),
+		CaaCheck:               c.Bool("caa-check"),
+		CaaResolver:            c.String("caa-resolver"),
 	}
-	sitesConfig := &common.SitesConfig{}
-	f, err := os.Open(c.String("config"))
-	if err != nil {
-		logger.WithError(err).Fatal("failed open config file")
+	switch config.OcspResponderFailure {
+	case acme_service.OcspResponderFailureWarn, acme_service.OcspResponderFailureFail:
+	default:
+		logger.WithField("value", config.OcspResponderFailure).Fatal("ocsp-responder-failure must be warn or fail")
 	}
-	configBytes, err := ioutil.ReadAll(f)
+	source, err := sites_config.NewSource(c.String("config"), c.Duration("config-watch-interval"), logger)
 	if err != nil {
-		logger.WithError(err).Fatal("failed read config file")
+		logger.WithError(err).Fatal("failed open sites config")
 	}
-	f.Close()
-	err = yaml.Unmarshal(configBytes, sitesConfig)
+	sitesConfig, err := source.Load()
 	if err != nil {
-		logger.WithError(err).Fatal("can not parse sites config")
+		logger.WithError(err).Fatal("failed load sites config")
 	}
 	logger.WithField("sites", len(sitesConfig.Sites)).Debug("sites config loaded")
 
 	store := MustInitStore(c)
 	acmeService := acme_service.NewAcmeService(config, sitesConfig, store, logger)
+	xds := xds_service.NewXdsService(logger)
+	acmeService.ChallengeServed = xds.WaitChallengeServed
 	acmeService.StartLoop()
+	acmeService.StartChallengeWatcher()
+	ocspErr := acmeService.StartOcspRefresher()
+	source.Watch(acmeService.UpdateSitesConfig)
+	defer source.Stop()
 
 	update := acmeService.NotificationChannel()
-	xds := xds_service.NewXdsService(logger)
 	ctx := context.Background()
 	xdsLis, err := net.Listen("tcp", c.String("xds-listen"))
 	if err != nil {
@@ -82,8 +93,51 @@ func CmdStart(c *cli.Context) error {
 		stop <- struct{}{}
 	}()
 
+	if addr := c.String("http01-listen"); addr != "" {
+		http01 := http01_service.NewHttp01Service(store, logger)
+		http01Lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			logger.WithError(err).Fatal("failed open http-01 listener")
+		}
+		go func() {
+			err := http01.RunServer(http01Lis)
+			if err != nil {
+				logger.WithError(err).Fatal("failed run http-01 server")
+			}
+			stop <- struct{}{}
+		}()
+	}
+
+	if addr := c.String("dns01-listen"); addr != "" {
+		zones := c.StringSlice("dns01-zone")
+		if len(zones) == 0 {
+			logger.Fatal("dns01-zone is required for the dns-01 server")
+		}
+		dns01 := dns01_service.NewDns01Service(store, zones, c.StringSlice("dns01-nameserver"), logger)
+		dns01Conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			logger.WithError(err).Fatal("failed open dns-01 udp listener")
+		}
+		dns01Lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			logger.WithError(err).Fatal("failed open dns-01 tcp listener")
+		}
+		go func() {
+			err := dns01.RunServer(dns01Conn, dns01Lis)
+			if err != nil {
+				logger.WithError(err).Fatal("failed run dns-01 server")
+			}
+			stop <- struct{}{}
+		}()
+	}
+
 	acmeService.FireNotification()
 
-	<-stop
+	select {
+	case <-stop:
+	case err := <-ocspErr:
+		logger.WithError(err).Error("stop because of ocsp-responder-failure fail")
+		return err
+	}
 	return nil
 }
@@ -63,6 +63,7 @@ func main() {
 					},
 					&cli.DurationFlag{
 						Name:    "interval",
+						Usage:   "interval to check all certificates. each certificate is also checked when its renewal is due",
 						EnvVars: []string{"INTERVAL"},
 						Value:   1 * time.Hour,
 					},
@@ -71,17 +72,92 @@ func main() {
 						EnvVars: []string{"LOCK_TIMEOUT"},
 						Value:   10 * time.Minute,
 					},
+					&cli.IntFlag{
+						Name:    "workers",
+						Usage:   "number of certificates checked in parallel",
+						EnvVars: []string{"WORKERS"},
+						Value:   4,
+					},
+					&cli.DurationFlag{
+						Name:    "backoff-base",
+						Usage:   "wait after the first renewal failure of a certificate, doubled on every failure",
+						EnvVars: []string{"BACKOFF_BASE"},
+						Value:   5 * time.Minute,
+					},
+					&cli.DurationFlag{
+						Name:    "backoff-max",
+						Usage:   "maximum wait after renewal failures",
+						EnvVars: []string{"BACKOFF_MAX"},
+						Value:   24 * time.Hour,
+					},
+					&cli.DurationFlag{
+						Name:    "ocsp-interval",
+						Usage:   "interval to refresh ocsp responses stapled to the certificates. 0 to disable",
+						EnvVars: []string{"OCSP_INTERVAL"},
+						Value:   1 * time.Hour,
+					},
+					&cli.StringFlag{
+						Name:    "ocsp-responder-failure",
+						Usage:   "warn: keep the last valid response when the ocsp responder fails. fail: exit when no valid response is left",
+						EnvVars: []string{"OCSP_RESPONDER_FAILURE"},
+						Value:   "warn",
+					},
+					&cli.BoolFlag{
+						Name:    "caa-check",
+						Usage:   "check the caa records of the domains before the order",
+						EnvVars: []string{"CAA_CHECK"},
+						Value:   true,
+					},
+					&cli.StringFlag{
+						Name:    "caa-resolver",
+						Usage:   "dns resolver address for the caa check. empty to use resolv.conf",
+						EnvVars: []string{"CAA_RESOLVER"},
+					},
+					&cli.DurationFlag{
+						Name:    "challenge-watch-interval",
+						Usage:   "interval to poll tls-alpn-01 challenges presented by other instances",
+						EnvVars: []string{"CHALLENGE_WATCH_INTERVAL"},
+						Value:   5 * time.Second,
+					},
 					&cli.StringFlag{
 						Name:    "config",
 						Aliases: []string{"c"},
+						Usage:   "sites config file, or consul://<key> to read it from consul kv",
 						EnvVars: []string{"CONFIG_FILE"},
 						Value:   "sites.yaml",
 					},
+					&cli.DurationFlag{
+						Name:    "config-watch-interval",
+						Usage:   "interval to check the config file for changes. 0 to reload on SIGHUP only",
+						EnvVars: []string{"CONFIG_WATCH_INTERVAL"},
+						Value:   10 * time.Second,
+					},
 					&cli.StringFlag{
 						Name:    "metrics-listen",
 						EnvVars: []string{"METRICS_LISTEN"},
 						Value:   "127.0.0.1:20001",
 					},
+					&cli.StringFlag{
+						Name:    "http01-listen",
+						Usage:   "listen address of http-01 challenge server. empty to disable",
+						EnvVars: []string{"HTTP01_LISTEN"},
+						Value:   "127.0.0.1:20002",
+					},
+					&cli.StringFlag{
+						Name:    "dns01-listen",
+						Usage:   "listen address (udp and tcp) of the authoritative dns server of dns-01 challenges. empty to disable",
+						EnvVars: []string{"DNS01_LISTEN"},
+					},
+					&cli.StringSliceFlag{
+						Name:    "dns01-zone",
+						Usage:   "zone delegated to the dns server, e.g. acme.example.com",
+						EnvVars: []string{"DNS01_ZONE"},
+					},
+					&cli.StringSliceFlag{
+						Name:    "dns01-nameserver",
+						Usage:   "host name of the dns server answered as the NS records of the zones, e.g. ns1.example.com",
+						EnvVars: []string{"DNS01_NAMESERVER"},
+					},
 				},
 				Action: CmdStart,
 			},
@@ -10,8 +10,8 @@ require (
 	github.com/Azure/go-autorest/autorest/validation v0.3.0 // indirect
 	github.com/akamai/AkamaiOPEN-edgegrid-golang v1.0.0 // indirect
 	github.com/aliyun/alibaba-cloud-sdk-go v1.61.623 // indirect
-	github.com/aws/aws-sdk-go v1.35.23 // indirect
-	github.com/cloudflare/cloudflare-go v0.13.4 // indirect
+	github.com/aws/aws-sdk-go v1.35.23
+	github.com/cloudflare/cloudflare-go v0.13.4
 	github.com/envoyproxy/go-control-plane v0.9.7
 	github.com/exoscale/egoscale v1.19.0 // indirect
 	github.com/ghodss/yaml v1.0.0
@@ -20,7 +20,7 @@ require (
 	github.com/hashicorp/consul/api v1.7.0
 	github.com/joho/godotenv v1.3.0
 	github.com/linode/linodego v0.24.0 // indirect
-	github.com/miekg/dns v1.1.35 // indirect
+	github.com/miekg/dns v1.1.35
 	github.com/oracle/oci-go-sdk v24.3.0+incompatible // indirect
 	github.com/prometheus/client_golang v1.8.0
 	github.com/rs/xid v1.2.1
@@ -28,8 +28,9 @@ require (
 	github.com/stretchr/testify v1.6.1
 	github.com/urfave/cli/v2 v2.3.0
 	github.com/vultr/govultr v1.1.1 // indirect
-	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897 // indirect
+	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897
 	golang.org/x/net v0.0.0-20201031054903-ff519b6c9102 // indirect
 	google.golang.org/api v0.35.0 // indirect
+	google.golang.org/genproto v0.0.0-20200904004341-0bd0a958aa1d
 	google.golang.org/grpc v1.31.1
 )
@@ -1,24 +1,29 @@
 package acme_service
 
 import (
+	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
 	"errors"
 	"fmt"
-	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge"
 	"github.com/go-acme/lego/v4/lego"
-	"github.com/go-acme/lego/v4/providers/dns"
 	"github.com/go-acme/lego/v4/registration"
 	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/dns_provider"
+	"github.com/kamijin-fanta/envoy-acme/pkg/http01_service"
 	"github.com/kamijin-fanta/envoy-acme/pkg/store"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/sirupsen/logrus"
-	"os"
+	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -31,229 +36,647 @@ var (
 		Namespace: common.PrometheusNamespace,
 		Name:      "renewal_failed",
 	})
+	renewalRateLimitedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: common.PrometheusNamespace,
+		Name:      "renewal_rate_limited",
+	})
 )
 
 type AcmeService struct {
-	Config              *AcmeProcessConfig
-	SitesConfig         *common.SitesConfig
-	Store               store.Store
+	Config *AcmeProcessConfig
+	Store  store.Store
+	// ChallengeServed waits until Envoy serves the tls-alpn-01 challenge certificate of the domain. It is set before StartLoop.
+	ChallengeServed     func(ctx context.Context, domain string) error
 	notificationChannel chan *common.Notification
 	logger              *logrus.Entry
+	httpClient          *http.Client
+
+	challengesMutex     sync.Mutex
+	publishedChallenges string
+
+	ocspWakeup chan struct{}
+	// certLocks serializes the renewal and the ocsp refresh of a certificate in this instance,
+	// because both hold the store lock with the instance id
+	certLocks *certLocks
+
+	// sitesConfig is swapped on reload while the loops iterate it, use SitesConfig and UpdateSitesConfig
+	sitesMutex   sync.RWMutex
+	sitesConfig  *common.SitesConfig
+	reloadWakeup chan struct{}
 }
 
 func NewAcmeService(config *AcmeProcessConfig, sitesConfig *common.SitesConfig, store store.Store, logger *logrus.Logger) *AcmeService {
 	return &AcmeService{
 		Config:              config,
-		SitesConfig:         sitesConfig,
 		Store:               store,
 		notificationChannel: make(chan *common.Notification),
 		logger:              logger.WithField("component", "acme_service"),
+		httpClient:          lego.NewConfig(nil).HTTPClient,
+		ocspWakeup:          make(chan struct{}, 1),
+		certLocks:           newCertLocks(),
+		sitesConfig:         sitesConfig,
+		reloadWakeup:        make(chan struct{}, 1),
+	}
+}
+
+// certLocks are the locks of the certificates in this instance.
+type certLocks struct {
+	mutex sync.Mutex
+	locks map[string]chan struct{}
+}
+
+func newCertLocks() *certLocks {
+	return &certLocks{
+		locks: map[string]chan struct{}{},
+	}
+}
+
+func (l *certLocks) get(name string) chan struct{} {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	lock, ok := l.locks[name]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		l.locks[name] = lock
+	}
+	return lock
+}
+
+func (l *certLocks) lock(name string) {
+	l.get(name) <- struct{}{}
+}
+
+// tryLock takes the lock unless it is held, and returns whether it was taken.
+func (l *certLocks) tryLock(name string) bool {
+	select {
+	case l.get(name) <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *certLocks) unlock(name string) {
+	<-l.get(name)
+}
+
+// SitesConfig returns the current sites config. It is replaced as a whole on reload, and never modified.
+func (a *AcmeService) SitesConfig() *common.SitesConfig {
+	a.sitesMutex.RLock()
+	defer a.sitesMutex.RUnlock()
+	return a.sitesConfig
+}
+
+// UpdateSitesConfig replaces the sites config with a validated one. Every certificate of the new config is checked
+// right away, so that new sites are issued, and the secrets of removed sites are dropped from the next notification.
+func (a *AcmeService) UpdateSitesConfig(sitesConfig *common.SitesConfig) {
+	a.sitesMutex.Lock()
+	previous := a.sitesConfig
+	a.sitesConfig = sitesConfig
+	a.sitesMutex.Unlock()
+	deleteCaaForbidden(previous, sitesConfig)
+
+	select {
+	case a.reloadWakeup <- struct{}{}:
+	default:
 	}
 }
 
 type AcmeProcessConfig struct {
-	CaDir       string
-	RemainDays  int
-	Interval    time.Duration
-	LockTimeout time.Duration
-	InstanceId  string
+	CaDir                  string
+	RemainDays             int
+	Interval               time.Duration
+	LockTimeout            time.Duration
+	InstanceId             string
+	ChallengeWatchInterval time.Duration
+	Workers                int
+	BackoffBase            time.Duration
+	BackoffMax             time.Duration
+	OcspInterval           time.Duration
+	OcspResponderFailure   string
+	CaaCheck               bool
+	CaaResolver            string
 }
 
 func (a *AcmeService) NotificationChannel() chan *common.Notification {
 	return a.notificationChannel
 }
 
-func (a *AcmeService) StartLoop() {
-	go func() {
-		for {
-			sitesChanges := false
-			for _, site := range a.SitesConfig.Sites {
-				siteLogger := a.logger.WithField("site", site.Name)
-				func() {
-					for retry := 0; true; retry += 1 {
-						ok, err := a.Store.Lock(a.Config.InstanceId, a.Config.LockTimeout)
-						if err != nil {
-							siteLogger.WithField("retry", retry).WithError(err).Debug("lock error")
-						}
-						if ok {
-							// success!
-							break
-						}
-						if retry > 10 {
-							siteLogger.WithField("retry", retry).Info("Skip because the lock cannot be obtained.")
-							return
-						}
-						siteLogger.WithField("retry", retry).Debug("lock failed")
-						wait := 5 * time.Second
-						siteLogger.WithField("duration", wait.String()).Debug("wait for lock")
-						time.Sleep(wait)
-					}
-					defer a.Store.Release(a.Config.InstanceId)
-					siteLogger.WithField("instance", a.Config.InstanceId).Debug("success lock")
-
-					defer func() {
-						if e := recover(); e != nil {
-							siteLogger.WithField("error", e).Warn("panic fetch certificate")
-						}
-					}()
-					siteLogger.Debug("check certificate")
-
-					// unset all relative env vars
-					for _, site := range a.SitesConfig.Sites {
-						for _, env := range site.LegoEnv {
-							vars := strings.Split(env, "=")
-							os.Unsetenv(vars[0])
-						}
-					}
-					result, err := a.FetchCertificate(site)
-					if err != nil {
-						siteLogger.WithError(err).Warn("renewal error")
-						renewalFailedCounter.Inc()
-						return
-					}
-					if result {
-						sitesChanges = true
-						siteLogger.Info("renewal success")
-						renewalSuccessCounter.Inc()
-					} else {
-						siteLogger.Info("not need renewal")
-					}
-				}()
-			}
-
-			a.FireNotification()
+// renewCertificate checks the certificate while holding its lock, so that instances sharing the store split the work.
+// It returns the time the next check of the certificate is due, and whether a certificate was issued.
+func (a *AcmeService) renewCertificate(cert *common.SiteCertificate) (due time.Time, renewed bool) {
+	siteLogger := a.logger.WithField("site", cert.Name)
+	// staples the new certificate, after the lock below is released because the ocsp refresh skips a locked one
+	defer func() {
+		if renewed {
+			a.wakeupOcspRefresher()
+		}
+	}()
+	// waits for the ocsp refresh of the certificate, which is a single request
+	a.certLocks.lock(cert.Name)
+	defer a.certLocks.unlock(cert.Name)
+	for retry := 0; true; retry += 1 {
+		ok, err := a.Store.Lock(cert.Name, a.Config.InstanceId, a.Config.LockTimeout)
+		if err == nil && ok {
+			// success!
+			break
+		}
+		if err == nil {
+			siteLogger.Info("Skip because the certificate is locked by another instance.")
+			return time.Now().Add(a.Config.LockTimeout), false
+		}
+		if retry >= 3 {
+			siteLogger.WithField("retry", retry).WithError(err).Warn("Skip because the lock cannot be obtained.")
+			return time.Now().Add(backoff(1, a.Config.BackoffBase, a.Config.BackoffMax)), false
+		}
+		siteLogger.WithField("retry", retry).WithError(err).Debug("lock error")
+		wait := 5 * time.Second
+		siteLogger.WithField("duration", wait.String()).Debug("wait for lock")
+		time.Sleep(wait)
+	}
+	defer a.Store.Release(cert.Name, a.Config.InstanceId)
+	siteLogger.WithField("instance", a.Config.InstanceId).Debug("success lock")
 
-			// wait for timer
-			t := time.NewTimer(a.Config.Interval)
-			<-t.C
+	defer func() {
+		if e := recover(); e != nil {
+			siteLogger.WithField("error", e).Warn("panic fetch certificate")
+			due = time.Now().Add(backoff(1, a.Config.BackoffBase, a.Config.BackoffMax))
 		}
 	}()
+	configHash := a.siteConfigHash(cert.Site)
+	failure := a.fetchFailure(siteLogger, cert, configHash)
+	if failure != nil && time.Now().Before(failure.NextAttempt) {
+		siteLogger.WithField("failures", failure.Count).WithField("next", failure.NextAttempt.Format(time.RFC3339)).Info("Skip until next attempt because of previous failures.")
+		return failure.NextAttempt, false
+	}
+	siteLogger.Debug("check certificate")
+
+	result, due, err := a.FetchCertificate(cert)
+	if err != nil {
+		failure = a.nextFailure(failure, err)
+		failure.ConfigHash = configHash
+		failureLogger := siteLogger.WithError(err).WithField("failures", failure.Count).WithField("next", failure.NextAttempt.Format(time.RFC3339))
+		if failure.RateLimited {
+			failureLogger.Warn("renewal rate limited by ca")
+			renewalRateLimitedCounter.Inc()
+		} else {
+			failureLogger.Warn("renewal error")
+		}
+		renewalFailedCounter.Inc()
+		err = a.Store.WriteFailure(cert.Name, failure)
+		if err != nil {
+			siteLogger.WithError(err).Warn("error on write failure state")
+		}
+		return failure.NextAttempt, false
+	}
+	err = a.reconcileTlsa(siteLogger, cert)
+	if err != nil {
+		siteLogger.WithError(err).Warn("error on publish tlsa records")
+	}
+	if failure != nil {
+		err = a.Store.DeleteFailure(cert.Name)
+		if err != nil {
+			siteLogger.WithError(err).Warn("error on delete failure state")
+		}
+	}
+	if result {
+		siteLogger.Info("renewal success")
+		renewalSuccessCounter.Inc()
+	} else {
+		siteLogger.Info("not need renewal")
+	}
+	siteLogger.WithField("due", due.Format(time.RFC3339)).Debug("next renewal")
+	return due, result
 }
 
-func (a *AcmeService) FetchCertificate(site *common.Site) (bool, error) {
-	siteLogger := a.logger.WithField("site", site.Name)
+// FetchCertificate issues the certificate if it has to be renewed.
+// It returns whether a certificate was issued and the time the certificate has to be renewed next.
+func (a *AcmeService) FetchCertificate(cert *common.SiteCertificate) (bool, time.Time, error) {
+	site := cert.Site
+	siteLogger := a.logger.WithField("site", cert.Name)
+	caDir := a.caDir(site)
 
-	resource, err := a.Store.FetchResource(site.Name)
+	// extra fields of the new order, which are added by orderTransport
+	var dir *directory
+	orderFields := map[string]interface{}{}
+
+	resource, err := a.Store.FetchResource(cert.Name)
 	if errors.Is(err, store.ErrNotFoundCertificate) {
 		// nop
 	} else if err != nil {
-		return false, fmt.Errorf("fetch resource error %w", err)
+		return false, time.Time{}, fmt.Errorf("fetch resource error %w", err)
 	} else {
 		// check expiration date
 		certs, err := resource.ExtractCertificate()
 		if err != nil {
-			return false, fmt.Errorf("extract certs error %w", err)
+			return false, time.Time{}, fmt.Errorf("extract certs error %w", err)
 		}
 		if len(certs) != 0 {
-			if !needRenewal(certs[0], a.Config.RemainDays) {
-				return false, nil
+			var info *renewalInfo
+			if a.issuedBy(resource) == caDir {
+				dir, info = a.fetchRenewalInfo(siteLogger, caDir, certs[0])
+			}
+			reason := a.renewalReason(cert, resource, certs[0], info)
+			if reason == "" {
+				if resource.PreferredChain != site.PreferredChain {
+					account, err := a.fetchUser(siteLogger, caDir, site.Email)
+					if err == nil {
+						err = a.selectChain(siteLogger, account, caDir, cert.Name, resource, site.PreferredChain)
+					}
+					if err != nil {
+						siteLogger.WithError(err).Warn("error on select chain")
+					}
+				}
+				return false, a.renewalDue(site, resource, certs[0], info), nil
 			}
+			siteLogger.WithField("reason", reason).Info("issue new certificate")
+			if info != nil {
+				certId, err := renewalCertId(certs[0])
+				if err == nil {
+					orderFields["replaces"] = certId
+				}
+			}
+		}
+	}
+
+	privateKey, keyCreatedAt, err := a.certificateKey(siteLogger, cert, resource)
+	var pending *tlsaPendingError
+	if errors.As(err, &pending) {
+		siteLogger.WithField("until", pending.until.Format(time.RFC3339)).Info("wait for the tlsa record of the next key")
+		return false, pending.until, nil
+	} else if err != nil {
+		return false, time.Time{}, err
+	}
+
+	if dir == nil && (site.Profile != "" || a.Config.CaaCheck) {
+		dir, err = fetchDirectory(a.httpClient, caDir)
+		if err != nil {
+			return false, time.Time{}, fmt.Errorf("error fetch directory %w", err)
+		}
+	}
+	if a.Config.CaaCheck {
+		err = a.checkCaa(siteLogger, site, dir)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+	}
+	var resolver *dns_provider.Resolver
+	if site.ChallengeType() == challenge.DNS01 {
+		resolver, err = siteResolver(site)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+		err = checkChallengeAliases(siteLogger, site, resolver)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+	}
+	if site.Profile != "" {
+		if _, ok := dir.Meta.Profiles[site.Profile]; !ok {
+			return false, time.Time{}, fmt.Errorf("profile '%s' is not offered by the ca %s", site.Profile, caDir)
 		}
+		orderFields["profile"] = site.Profile
 	}
 
-	account, err := a.Store.FetchUser(a.Config.CaDir, site.Email)
+	account, err := a.fetchUser(siteLogger, caDir, site.Email)
 	if errors.Is(err, store.ErrNotFoundUser) {
 		// regist new user
 		siteLogger.WithField("email", site.Email).Info("generate user private key")
 
 		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 		if err != nil {
-			return false, fmt.Errorf("error generate private key %w", err)
+			return false, time.Time{}, fmt.Errorf("error generate private key %w", err)
 		}
 
 		newAccount := store.NewAccount(site.Email, privateKey)
 		clientConfig := lego.NewConfig(newAccount)
 
-		clientConfig.CADirURL = a.Config.CaDir
+		clientConfig.CADirURL = caDir
+		retryAfter := &retryAfterTransport{base: clientConfig.HTTPClient.Transport}
+		clientConfig.HTTPClient.Transport = retryAfter
 
 		client, err := lego.NewClient(clientConfig)
 		if err != nil {
-			return false, fmt.Errorf("error create new lego client %w", err)
+			return false, time.Time{}, fmt.Errorf("error create new lego client %w", err)
 		}
 
-		reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+		var reg *registration.Resource
+		if eab := a.SitesConfig().ExternalAccountBinding(site, caDir); eab != nil {
+			var hmac string
+			hmac, err = eab.Hmac()
+			if err != nil {
+				return false, time.Time{}, err
+			}
+			siteLogger.WithField("kid", eab.EabKid).Info("register user with external account binding")
+			reg, err = client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+				TermsOfServiceAgreed: true,
+				Kid:                  eab.EabKid,
+				HmacEncoded:          hmac,
+			})
+		} else {
+			reg, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+		}
 		if err != nil {
-			return false, fmt.Errorf("error acme user registration %w", err)
+			return false, time.Time{}, fmt.Errorf("error acme user registration %w", retryAfter.wrapError(err))
 		}
 		newAccount.Registration = reg
 		account = newAccount
 
-		err = a.Store.WriteUser(a.Config.CaDir, newAccount)
+		err = a.Store.WriteUser(caDir, newAccount)
 		if err != nil {
-			return false, fmt.Errorf("error write new user %w", err)
+			return false, time.Time{}, fmt.Errorf("error write new user %w", err)
 		}
 	} else if err != nil {
-		return false, fmt.Errorf("error on fetch user %w", err)
+		return false, time.Time{}, fmt.Errorf("error on fetch user %w", err)
 	}
 
 	clientConfig := lego.NewConfig(account)
-	clientConfig.Certificate.KeyType = certcrypto.RSA2048
-	clientConfig.CADirURL = a.Config.CaDir
+	clientConfig.CADirURL = caDir
+	retryAfter := &retryAfterTransport{base: clientConfig.HTTPClient.Transport}
+	clientConfig.HTTPClient.Transport = retryAfter
+	if dir != nil && len(orderFields) != 0 {
+		clientConfig.HTTPClient.Transport = &orderTransport{
+			base:        clientConfig.HTTPClient.Transport,
+			privateKey:  account.GetPrivateKey(),
+			newOrderURL: dir.NewOrderURL,
+			fields:      orderFields,
+			logger:      siteLogger,
+		}
+	}
 
 	client, err := lego.NewClient(clientConfig)
 	if err != nil {
-		return false, fmt.Errorf("error create new lego client %w", err)
+		return false, time.Time{}, fmt.Errorf("error create new lego client %w", err)
 	}
 
-	// set EnvVars
-	for _, env := range site.LegoEnv {
-		vars := strings.Split(env, "=")
-		if len(vars) != 2 {
-			siteLogger.WithField("variable", env).Info("ignore invalid env vars")
-			continue
+	switch site.ChallengeType() {
+	case challenge.HTTP01:
+		err = client.Challenge.SetHTTP01Provider(http01_service.NewProvider(a.Store))
+		if err != nil {
+			return false, time.Time{}, fmt.Errorf("error on set provider %w", err)
 		}
-		err := os.Setenv(vars[0], vars[1])
-		siteLogger.WithField("key", vars[0]).Trace("set env var")
+	case challenge.TLSALPN01:
+		err = client.Challenge.SetTLSALPN01Provider(newTlsAlpn01Provider(a))
 		if err != nil {
-			panic(err)
+			return false, time.Time{}, fmt.Errorf("error on set provider %w", err)
 		}
-	}
-	provider, err := dns.NewDNSChallengeProviderByName(site.Provider)
-	if err != nil {
-		return false, fmt.Errorf("error on new provider %w", err)
-	}
-	err = client.Challenge.SetDNS01Provider(provider)
-	if err != nil {
-		return false, fmt.Errorf("error on set provider %w", err)
+	case challenge.DNS01:
+		provider, err := a.siteDNSProvider(site, resolver)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+		provider, options, err := propagationOptions(site, provider)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+		err = client.Challenge.SetDNS01Provider(provider, options...)
+		if err != nil {
+			return false, time.Time{}, fmt.Errorf("error on set provider %w", err)
+		}
+	default:
+		return false, time.Time{}, fmt.Errorf("unsupported challenge type '%s'", site.Challenge)
 	}
 
 	request := certificate.ObtainRequest{
-		Domains: site.Domains,
-		Bundle:  true,
+		Domains:        site.Domains,
+		Bundle:         true,
+		PrivateKey:     privateKey,
+		PreferredChain: site.PreferredChain,
 	}
-	siteLogger.WithField("request", request).Debug("start obtain request")
+	siteLogger.WithField("domains", request.Domains).WithField("key_type", cert.KeyType).WithField("profile", site.Profile).Debug("start obtain request")
 	certificates, err := client.Certificate.Obtain(request)
 	if err != nil {
-		return false, fmt.Errorf("error obtain certificate %w", err)
+		return false, time.Time{}, fmt.Errorf("error obtain certificate %w", retryAfter.wrapError(err))
 	}
 	certResource := store.NewStoreResource(certificates)
+	certResource.KeyType = cert.KeyType
+	certResource.CaDir = caDir
+	certResource.Profile = site.Profile
+	certResource.PreferredChain = site.PreferredChain
+	certResource.ChainIssuer = chainIssuer(certResource.IssuerCertificate)
+	certResource.KeyCreatedAt = &keyCreatedAt
+	if resource != nil {
+		certResource.TlsaRecords = resource.TlsaRecords
+		if !bytes.Equal(certResource.PrivateKey, resource.NextPrivateKey) {
+			certResource.NextPrivateKey = resource.NextPrivateKey
+			certResource.NextKeyPublishedAt = resource.NextKeyPublishedAt
+		}
+	}
 
-	err = a.Store.WriteResource(site.Name, certResource)
+	err = a.Store.WriteResource(cert.Name, certResource)
 	if err != nil {
-		return false, fmt.Errorf("issue certificate error %w", err)
+		return false, time.Time{}, fmt.Errorf("issue certificate error %w", err)
 	}
-	return true, nil
+
+	// the next check is left to the full check when the issued certificate can not be read
+	due := time.Now().Add(a.Config.Interval)
+	leafs, err := certResource.ExtractCertificate()
+	if err != nil || len(leafs) == 0 {
+		siteLogger.WithError(err).Warn("error on extract issued certificate")
+	} else if next := a.renewalDue(site, certResource, leafs[0], nil); next.After(time.Now()) {
+		due = next
+	} else {
+		siteLogger.WithField("not_after", leafs[0].NotAfter.Format(time.RFC3339)).Warn("issued certificate is already due for renewal, check renew_before")
+	}
+	return true, due, nil
+}
+
+// StartChallengeWatcher polls the tls-alpn-01 challenges in the store,
+// so that challenges presented by other instances are also published to the local Envoy.
+func (a *AcmeService) StartChallengeWatcher() {
+	go func() {
+		for {
+			t := time.NewTimer(a.Config.ChallengeWatchInterval)
+			<-t.C
+
+			challenges, err := a.Store.ListChallenges(string(challenge.TLSALPN01))
+			if err != nil {
+				a.logger.WithError(err).Warn("error on list challenges")
+				continue
+			}
+			a.challengesMutex.Lock()
+			changed := a.publishedChallenges != challengeTokens(challenges)
+			a.challengesMutex.Unlock()
+			if changed {
+				a.logger.WithField("challenges", len(challenges)).Debug("tls-alpn-01 challenges changed")
+				a.FireNotification()
+			}
+		}
+	}()
 }
 
 func (a *AcmeService) FireNotification() {
-	certs := make([]*store.Certificates, 0, len(a.SitesConfig.Sites))
-	for _, site := range a.SitesConfig.Sites {
-		cert, err := a.Store.FetchResource(site.Name)
+	certs := make(map[string]*store.Certificates)
+	var primaries []*store.Certificates
+	now := time.Now()
+	for _, siteCert := range a.SitesConfig().Certificates() {
+		cert, err := a.Store.FetchResource(siteCert.Name)
 		if err != nil {
-			a.logger.WithError(err).Warn("error on fetch resource")
+			a.logger.WithError(err).WithField("site", siteCert.Name).Warn("error on fetch resource")
 			continue
 		}
-		certs = append(certs, cert)
+		cert.OcspStaple = validOcspStaple(cert.OcspStaple, now)
+		certs[siteCert.Name] = cert
+		if siteCert.Name == siteCert.Site.Name {
+			primaries = append(primaries, cert)
+		}
+	}
+	// earlier versions named the secret after the first domain, which is kept as an alias of the primary certificate
+	// so that the listeners referring to it keep their certificates. The names of the sites take precedence.
+	for _, cert := range primaries {
+		if _, ok := certs[cert.Domain]; !ok && cert.Domain != "" {
+			certs[cert.Domain] = cert
+		}
+	}
+	challenges, err := a.Store.ListChallenges(string(challenge.TLSALPN01))
+	if err != nil {
+		a.logger.WithError(err).Warn("error on list challenges")
 	}
+
+	a.challengesMutex.Lock()
+	a.publishedChallenges = challengeTokens(challenges)
+	a.challengesMutex.Unlock()
+
 	a.notificationChannel <- &common.Notification{
 		Certificates: certs,
+		Challenges:   challenges,
 	}
 }
 
-func needRenewal(x509Cert *x509.Certificate, remainDay int) bool {
-	if remainDay < 0 {
-		return true
+func challengeTokens(challenges []*store.Challenge) string {
+	tokens := make([]string, 0, len(challenges))
+	for _, chlg := range challenges {
+		tokens = append(tokens, chlg.Token)
+	}
+	sort.Strings(tokens)
+	return strings.Join(tokens, ",")
+}
+
+// caDir returns the ACME directory of the site. --ca-dir is used when the site does not override it.
+func (a *AcmeService) caDir(site *common.Site) string {
+	if site.CaDir != "" {
+		return site.CaDir
+	}
+	return a.Config.CaDir
+}
+
+// issuedBy returns the ACME directory the certificate was issued by.
+// Resources written by earlier versions have no ca dir, they were issued by --ca-dir.
+func (a *AcmeService) issuedBy(resource *store.Certificates) string {
+	if resource.CaDir == "" {
+		return a.Config.CaDir
+	}
+	return resource.CaDir
+}
+
+// fetchUser returns the account of the email for the ACME directory.
+// Earlier versions stored the account of --ca-dir by its host only, it is moved to the key of the directory.
+// Other directories of the same host have their own accounts and never use it.
+func (a *AcmeService) fetchUser(siteLogger *logrus.Entry, caDir string, email string) (*store.Account, error) {
+	account, err := a.Store.FetchUser(caDir, email)
+	if !errors.Is(err, store.ErrNotFoundUser) || caDir != a.Config.CaDir {
+		return account, err
+	}
+	account, err = a.Store.FetchLegacyUser(caDir, email)
+	if err != nil {
+		return nil, err
+	}
+	siteLogger.WithField("email", email).Info("migrate user of earlier version")
+	err = a.Store.WriteUser(caDir, account)
+	if err != nil {
+		return nil, fmt.Errorf("error write migrated user %w", err)
+	}
+	return account, nil
+}
+
+// fetchRenewalInfo fetches the ACME Renewal Information of the certificate.
+// nil is returned when the ca does not support it, and the remaining days are used instead.
+func (a *AcmeService) fetchRenewalInfo(siteLogger *logrus.Entry, caDir string, leaf *x509.Certificate) (*directory, *renewalInfo) {
+	dir, err := fetchDirectory(a.httpClient, caDir)
+	if err != nil {
+		siteLogger.WithError(err).Warn("error on fetch directory")
+		return nil, nil
+	}
+	info, err := fetchRenewalInfo(a.httpClient, dir, leaf)
+	if errors.Is(err, ErrRenewalInfoNotSupported) {
+		return dir, nil
+	} else if err != nil {
+		siteLogger.WithError(err).Warn("error on fetch renewal info")
+		return dir, nil
+	}
+	siteLogger.WithField("start", info.SuggestedWindow.Start).WithField("end", info.SuggestedWindow.End).Debug("renewal info")
+	return dir, info
+}
+
+// renewalReason returns why the stored certificate has to be issued again, or an empty string if it is still valid for the site.
+func (a *AcmeService) renewalReason(cert *common.SiteCertificate, resource *store.Certificates, leaf *x509.Certificate, info *renewalInfo) string {
+	if !sameDomains(leaf.DNSNames, cert.Site.Domains) {
+		return fmt.Sprintf("domains changed from %v to %v", leaf.DNSNames, cert.Site.Domains)
+	}
+	if resource.CertKeyType() != cert.KeyType {
+		return fmt.Sprintf("key type changed from %s to %s", resource.CertKeyType(), cert.KeyType)
+	}
+	if caDir := a.caDir(cert.Site); a.issuedBy(resource) != caDir {
+		return fmt.Sprintf("ca changed from %s to %s", a.issuedBy(resource), caDir)
+	}
+	if resource.Profile != cert.Site.Profile {
+		return fmt.Sprintf("profile changed from '%s' to '%s'", resource.Profile, cert.Site.Profile)
+	}
+	if rotation, ok := keyRotationDue(cert.Site, resource, leaf); ok && !time.Now().Before(rotation) {
+		return fmt.Sprintf("key rotation due at %s", rotation.Format(time.RFC3339))
+	}
+	if info != nil && !time.Now().Before(info.RenewalTime(leaf)) {
+		reason := fmt.Sprintf("in renewal window %s - %s suggested by ca", info.SuggestedWindow.Start.Format(time.RFC3339), info.SuggestedWindow.End.Format(time.RFC3339))
+		if info.ExplanationURL != "" {
+			reason += ", see " + info.ExplanationURL
+		}
+		return reason
+	}
+	if a.needRenewal(cert.Site, leaf) {
+		return fmt.Sprintf("expires at %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	return ""
+}
+
+// sameDomains reports whether both lists have the same domains, ignoring the case, the order and duplicates.
+func sameDomains(a, b []string) bool {
+	setA, setB := domainSet(a), domainSet(b)
+	if len(setA) != len(setB) {
+		return false
+	}
+	for domain := range setA {
+		if !setB[domain] {
+			return false
+		}
+	}
+	return true
+}
+
+func domainSet(domains []string) map[string]bool {
+	set := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		set[strings.ToLower(domain)] = true
+	}
+	return set
+}
+
+func (a *AcmeService) needRenewal(site *common.Site, x509Cert *x509.Certificate) bool {
+	return !time.Now().Before(a.expiryDue(site, x509Cert))
+}
+
+// expiryDue returns the time the certificate is renewed by the renew_before of the site.
+// Without it, the certificate is renewed when fewer than --cert-days days remain,
+// but not before a third of the lifetime remains, so that short-lived certificates are not renewed on every check.
+func (a *AcmeService) expiryDue(site *common.Site, x509Cert *x509.Certificate) time.Time {
+	if policy := site.RenewalPolicy(); policy != nil {
+		return x509Cert.NotAfter.Add(-policy.Before(x509Cert.NotBefore, x509Cert.NotAfter))
+	}
+	if a.Config.RemainDays < 0 {
+		return time.Time{}
+	}
+	before := time.Duration(a.Config.RemainDays) * 24 * time.Hour
+	if third := x509Cert.NotAfter.Sub(x509Cert.NotBefore) / 3; third < before {
+		before = third
 	}
-	notAfter := int(time.Until(x509Cert.NotAfter).Hours() / 24.0)
-	return notAfter <= remainDay
+	return x509Cert.NotAfter.Add(-before)
 }
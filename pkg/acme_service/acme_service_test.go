@@ -0,0 +1,215 @@
+package acme_service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store/file_store"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func generateLeaf(t *testing.T, domains []string, notBefore, notAfter time.Time) *x509.Certificate {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domains[0]},
+		DNSNames:     domains,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	require.Nil(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return leaf
+}
+
+func TestRenewalReason(t *testing.T) {
+	assert := assert.New(t)
+
+	caDir := "https://acme-staging-v02.api.letsencrypt.org/directory"
+	service := NewAcmeService(&AcmeProcessConfig{
+		CaDir:      caDir,
+		RemainDays: 25,
+	}, &common.SitesConfig{}, nil, logrus.New())
+	site := &common.Site{
+		Name:    "example",
+		Domains: []string{"example.com", "*.example.com"},
+		KeyType: common.KeyTypeEC256,
+	}
+	cert := site.Certificates()[0]
+	resource := &store.Certificates{
+		KeyType: common.KeyTypeEC256,
+		CaDir:   caDir,
+	}
+	leaf := generateLeaf(t, []string{"*.EXAMPLE.com", "example.com"}, time.Now(), time.Now().Add(90*24*time.Hour))
+
+	assert.Equal("", service.renewalReason(cert, resource, leaf, nil))
+
+	expiring := generateLeaf(t, site.Domains, time.Now().Add(-80*24*time.Hour), time.Now().Add(10*24*time.Hour))
+	assert.Contains(service.renewalReason(cert, resource, expiring, nil), "expires at")
+
+	moreDomains := &common.Site{
+		Name:    "example",
+		Domains: []string{"example.com", "*.example.com", "www.example.net"},
+		KeyType: common.KeyTypeEC256,
+	}
+	assert.Contains(service.renewalReason(moreDomains.Certificates()[0], resource, leaf, nil), "domains changed")
+
+	// the ca removes duplicates from the certificate
+	assert.True(sameDomains([]string{"example.com"}, []string{"example.com", "EXAMPLE.com"}))
+	assert.False(sameDomains([]string{"a.example.com", "b.example.com"}, []string{"a.example.com", "a.example.com"}))
+
+	rsaSite := &common.Site{
+		Name:    "example",
+		Domains: site.Domains,
+	}
+	assert.Contains(service.renewalReason(rsaSite.Certificates()[0], resource, leaf, nil), "key type changed")
+
+	otherCa := &store.Certificates{
+		KeyType: common.KeyTypeEC256,
+		CaDir:   "https://acme.example.com/directory",
+	}
+	assert.Contains(service.renewalReason(cert, otherCa, leaf, nil), "ca changed")
+
+	legacy := &store.Certificates{}
+	assert.Equal("", service.renewalReason(rsaSite.Certificates()[0], legacy, leaf, nil))
+
+	siteCa := &common.Site{
+		Name:    "example",
+		Domains: site.Domains,
+		CaDir:   "https://ca.internal/acme/acme/directory",
+	}
+	assert.Contains(service.renewalReason(siteCa.Certificates()[0], legacy, leaf, nil), "ca changed")
+	assert.Equal("", service.renewalReason(siteCa.Certificates()[0], &store.Certificates{CaDir: siteCa.CaDir}, leaf, nil))
+
+	profileSite := &common.Site{
+		Name:    "example",
+		Domains: site.Domains,
+		KeyType: common.KeyTypeEC256,
+		Profile: "tlsserver",
+	}
+	assert.Contains(service.renewalReason(profileSite.Certificates()[0], resource, leaf, nil), "profile changed")
+	profileResource := &store.Certificates{
+		KeyType: common.KeyTypeEC256,
+		CaDir:   caDir,
+		Profile: "tlsserver",
+	}
+	assert.Equal("", service.renewalReason(profileSite.Certificates()[0], profileResource, leaf, nil))
+	assert.Contains(service.renewalReason(cert, profileResource, leaf, nil), "profile changed")
+}
+
+// userRecorder counts the accounts written to the store
+type userRecorder struct {
+	store.Store
+	written int
+}
+
+func (u *userRecorder) WriteUser(caServer string, account *store.Account) error {
+	u.written++
+	return u.Store.WriteUser(caServer, account)
+}
+
+func TestFetchCertificateEabFailure(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+		switch r.URL.Path {
+		case "/directory":
+			fmt.Fprintf(w, `{"newNonce":"%[1]s/nonce","newAccount":"%[1]s/account","newOrder":"%[1]s/order"}`, server.URL)
+		case "/nonce":
+		case "/account":
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"type":"urn:ietf:params:acme:error:unauthorized","detail":"invalid eab"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "acme-eab")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	fileStore, err := file_store.NewFileStore(dir)
+	require.Nil(err)
+	recorder := &userRecorder{Store: fileStore}
+
+	site := &common.Site{
+		Name:      "example",
+		Challenge: "http-01",
+		Email:     "test@example.com",
+		Domains:   []string{"example.com"},
+		KeyType:   common.KeyTypeEC256,
+		ExternalAccountBinding: common.ExternalAccountBinding{
+			EabKid:  "kid",
+			EabHmac: "c2VjcmV0",
+		},
+	}
+	service := NewAcmeService(&AcmeProcessConfig{CaDir: server.URL + "/directory"}, &common.SitesConfig{Sites: []*common.Site{site}}, recorder, logrus.New())
+
+	_, _, err = service.FetchCertificate(site.Certificates()[0])
+	require.Error(err)
+	assert.Contains(err.Error(), "invalid eab")
+	// the account is not stored without a registration, so that the next attempt registers again
+	assert.Equal(0, recorder.written)
+}
+
+// legacyStore has an account of an earlier version, keyed by the host of the directory
+type legacyStore struct {
+	userRecorder
+	legacy *store.Account
+}
+
+func (l *legacyStore) FetchLegacyUser(caServer string, userId string) (*store.Account, error) {
+	return l.legacy, nil
+}
+
+func TestFetchLegacyUser(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "acme-legacy-user")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	fileStore, err := file_store.NewFileStore(dir)
+	require.Nil(err)
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(err)
+	legacy := &legacyStore{userRecorder: userRecorder{Store: fileStore}, legacy: store.NewAccount("test@example.com", privateKey)}
+
+	caDir := "https://ca.internal/acme/directory"
+	service := NewAcmeService(&AcmeProcessConfig{CaDir: caDir}, &common.SitesConfig{}, legacy, logrus.New())
+	siteLogger := logrus.NewEntry(logrus.New())
+
+	// another directory of the same host registers its own account
+	_, err = service.fetchUser(siteLogger, "https://ca.internal/acme/other/directory", "test@example.com")
+	assert.Equal(store.ErrNotFoundUser, err)
+
+	// the account of --ca-dir is moved to the key of the directory
+	account, err := service.fetchUser(siteLogger, caDir, "test@example.com")
+	require.Nil(err)
+	assert.Equal(privateKey, account.GetPrivateKey())
+	assert.Equal(1, legacy.written)
+	account, err = fileStore.FetchUser(caDir, "test@example.com")
+	require.Nil(err)
+	assert.Equal(privateKey, account.GetPrivateKey())
+}
@@ -0,0 +1,114 @@
+package acme_service
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ErrRenewalInfoNotSupported = errors.New("renewal info is not supported by the ca")
+
+// directory is the subset of the ACME directory object used by envoy-acme.
+// It has fields which the bundled lego version does not know.
+type directory struct {
+	NewNonceURL    string `json:"newNonce"`
+	NewOrderURL    string `json:"newOrder"`
+	RenewalInfoURL string `json:"renewalInfo"`
+	Meta           struct {
+		// Profiles maps the profile names offered by the ca to their descriptions
+		Profiles map[string]string `json:"profiles"`
+		// CaaIdentities are the issuer domain names of the ca in CAA records
+		CaaIdentities []string `json:"caaIdentities"`
+	} `json:"meta"`
+}
+
+func fetchDirectory(httpClient *http.Client, caDir string) (*directory, error) {
+	resp, err := httpClient.Get(caDir)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from directory %s", resp.StatusCode, caDir)
+	}
+
+	dir := new(directory)
+	err = json.NewDecoder(resp.Body).Decode(dir)
+	if err != nil {
+		return nil, err
+	}
+	return dir, nil
+}
+
+// renewalInfo is the ACME Renewal Information of a certificate. See RFC 9773.
+type renewalInfo struct {
+	SuggestedWindow struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+	} `json:"suggestedWindow"`
+	ExplanationURL string `json:"explanationURL,omitempty"`
+}
+
+func fetchRenewalInfo(httpClient *http.Client, dir *directory, leaf *x509.Certificate) (*renewalInfo, error) {
+	if dir.RenewalInfoURL == "" {
+		return nil, ErrRenewalInfoNotSupported
+	}
+	certId, err := renewalCertId(leaf)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Get(strings.TrimSuffix(dir.RenewalInfoURL, "/") + "/" + certId)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from renewal info", resp.StatusCode)
+	}
+
+	info := new(renewalInfo)
+	err = json.NewDecoder(resp.Body).Decode(info)
+	if err != nil {
+		return nil, err
+	}
+	if info.SuggestedWindow.End.Before(info.SuggestedWindow.Start) {
+		return nil, fmt.Errorf("invalid suggested window %s - %s", info.SuggestedWindow.Start, info.SuggestedWindow.End)
+	}
+	return info, nil
+}
+
+// RenewalTime returns the time within the suggested window at which the certificate should be renewed.
+// The time is derived from the certificate, so every instance and every check picks the same one.
+func (r *renewalInfo) RenewalTime(leaf *x509.Certificate) time.Time {
+	window := r.SuggestedWindow.End.Sub(r.SuggestedWindow.Start)
+	if window <= 0 {
+		return r.SuggestedWindow.Start
+	}
+	sum := sha256.Sum256(leaf.Raw)
+	offset := time.Duration(binary.BigEndian.Uint64(sum[:8]) % uint64(window))
+	return r.SuggestedWindow.Start.Add(offset)
+}
+
+// renewalCertId returns the unique identifier of the certificate for renewalInfo and the "replaces" field of new orders.
+func renewalCertId(leaf *x509.Certificate) (string, error) {
+	if len(leaf.AuthorityKeyId) == 0 {
+		return "", errors.New("certificate has no authority key identifier")
+	}
+	if leaf.SerialNumber == nil {
+		return "", errors.New("certificate has no serial number")
+	}
+	// DER encoding of the serial number value, which must not be negative
+	serial := leaf.SerialNumber.Bytes()
+	if len(serial) == 0 || serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+	return base64.RawURLEncoding.EncodeToString(leaf.AuthorityKeyId) + "." + base64.RawURLEncoding.EncodeToString(serial), nil
+}
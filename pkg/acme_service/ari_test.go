@@ -0,0 +1,169 @@
+package acme_service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenewalCertId(t *testing.T) {
+	// example of RFC 9773 section 4.1
+	leaf := &x509.Certificate{
+		AuthorityKeyId: []byte{0x69, 0x88, 0x5B, 0x6B, 0x87, 0x46, 0x40, 0x41, 0xE1, 0xB3, 0x7B, 0x84, 0x7B, 0xA0, 0xAE, 0x2C, 0xDE, 0x01, 0xC8, 0xD4},
+		SerialNumber:   big.NewInt(0x87654321),
+	}
+	certId, err := renewalCertId(leaf)
+	require.Nil(t, err)
+	assert.Equal(t, "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE", certId)
+}
+
+func TestFetchRenewalInfo(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	end := start.Add(2 * time.Hour)
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"newOrder": "%s/new-order", "renewalInfo": "%s/renewal-info"}`, server.URL, server.URL)
+	})
+	mux.HandleFunc("/renewal-info/aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"suggestedWindow": {"start": "%s", "end": "%s"}}`, start.Format(time.RFC3339), end.Format(time.RFC3339))
+	})
+
+	dir, err := fetchDirectory(server.Client(), server.URL+"/directory")
+	require.Nil(err)
+	assert.Equal(server.URL+"/new-order", dir.NewOrderURL)
+
+	leaf := &x509.Certificate{
+		Raw:            []byte("raw"),
+		AuthorityKeyId: []byte{0x69, 0x88, 0x5B, 0x6B, 0x87, 0x46, 0x40, 0x41, 0xE1, 0xB3, 0x7B, 0x84, 0x7B, 0xA0, 0xAE, 0x2C, 0xDE, 0x01, 0xC8, 0xD4},
+		SerialNumber:   big.NewInt(0x87654321),
+	}
+	info, err := fetchRenewalInfo(server.Client(), dir, leaf)
+	require.Nil(err)
+	assert.True(start.Equal(info.SuggestedWindow.Start))
+	assert.True(end.Equal(info.SuggestedWindow.End))
+
+	renewalTime := info.RenewalTime(leaf)
+	assert.False(renewalTime.Before(start))
+	assert.True(renewalTime.Before(end))
+	assert.Equal(renewalTime, info.RenewalTime(leaf))
+
+	_, err = fetchRenewalInfo(server.Client(), &directory{}, leaf)
+	assert.Equal(ErrRenewalInfoNotSupported, err)
+}
+
+func TestOrderTransportRewrite(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(err)
+
+	transport := &orderTransport{
+		privateKey: privateKey,
+		fields:     map[string]interface{}{"replaces": "cert-id"},
+	}
+	protected := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256","nonce":"nonce","url":"https://ca/new-order"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"identifiers":[{"type":"dns","value":"example.com"}]}`))
+	body, err := json.Marshal(&flattenedJws{Protected: protected, Payload: payload, Signature: "invalid"})
+	require.Nil(err)
+
+	body, err = transport.rewrite(body, transport.fields, "")
+	require.Nil(err)
+	jws := new(flattenedJws)
+	require.Nil(json.Unmarshal(body, jws))
+	assert.Equal(protected, jws.Protected)
+
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	require.Nil(err)
+	assert.JSONEq(`{"identifiers":[{"type":"dns","value":"example.com"}],"replaces":"cert-id"}`, string(payloadBytes))
+
+	signature, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	require.Nil(err)
+	require.Len(signature, 64)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	assert.True(ecdsa.Verify(&privateKey.PublicKey, digest[:], r, s))
+}
+
+func TestOrderTransportRetryWithoutReplaces(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(err)
+
+	type order struct {
+		nonce   string
+		payload map[string]interface{}
+	}
+	var orders []order
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jws := new(flattenedJws)
+		assert.Nil(json.NewDecoder(r.Body).Decode(jws))
+		protectedBytes, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+		payloadBytes, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+		protected := map[string]interface{}{}
+		payload := map[string]interface{}{}
+		assert.Nil(json.Unmarshal(protectedBytes, &protected))
+		assert.Nil(json.Unmarshal(payloadBytes, &payload))
+		orders = append(orders, order{nonce: protected["nonce"].(string), payload: payload})
+
+		w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", len(orders)))
+		if _, ok := payload["replaces"]; ok {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `{"type":"urn:ietf:params:acme:error:alreadyReplaced","detail":"certificate already replaced"}`)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"status":"pending"}`)
+	}))
+	defer server.Close()
+
+	transport := &orderTransport{
+		base:        http.DefaultTransport,
+		privateKey:  privateKey,
+		newOrderURL: server.URL + "/new-order",
+		fields:      map[string]interface{}{"replaces": "cert-id", "profile": "tlsserver"},
+		logger:      logrus.NewEntry(logrus.New()),
+	}
+	protected := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256","nonce":"nonce-0","url":"` + server.URL + `/new-order"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"identifiers":[{"type":"dns","value":"example.com"}]}`))
+	body, err := json.Marshal(&flattenedJws{Protected: protected, Payload: payload, Signature: "invalid"})
+	require.Nil(err)
+
+	resp, err := (&http.Client{Transport: transport}).Post(server.URL+"/new-order", "application/jose+json", strings.NewReader(string(body)))
+	require.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	// lego takes the nonce of the last response
+	assert.Equal("nonce-2", resp.Header.Get("Replay-Nonce"))
+
+	require.Len(orders, 2)
+	assert.Equal("nonce-0", orders[0].nonce)
+	assert.Equal("cert-id", orders[0].payload["replaces"])
+	// the order is sent again with the nonce of the rejection, without replaces
+	assert.Equal("nonce-1", orders[1].nonce)
+	assert.NotContains(orders[1].payload, "replaces")
+	assert.Equal("tlsserver", orders[1].payload["profile"])
+}
@@ -0,0 +1,190 @@
+package acme_service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rateLimitedErr = "urn:ietf:params:acme:error:rateLimited"
+
+// minRateLimitedBackoff is used when the CA limits the rate without telling when to retry.
+const minRateLimitedBackoff = 1 * time.Hour
+
+// RateLimitedError is returned when the CA rejected a request with the rateLimited error.
+type RateLimitedError struct {
+	// RetryAfter is zero when the CA did not send the Retry-After header
+	RetryAfter time.Time
+	Err        error
+}
+
+func (r *RateLimitedError) Error() string {
+	return r.Err.Error()
+}
+
+func (r *RateLimitedError) Unwrap() error {
+	return r.Err
+}
+
+func isRateLimited(err error) bool {
+	var problem *acme.ProblemDetails
+	if errors.As(err, &problem) {
+		return problem.Type == rateLimitedErr
+	}
+	// errors of lego per domain do not wrap the problem details
+	return strings.Contains(err.Error(), rateLimitedErr)
+}
+
+// fetchFailure returns the failure state of the certificate, or nil when it has not failed.
+// The state is deleted when the config of the site has changed since the failure, e.g. after a broken site is fixed,
+// so that it is retried right away. Rate limits of the ca are still honored.
+func (a *AcmeService) fetchFailure(siteLogger *logrus.Entry, cert *common.SiteCertificate, configHash string) *store.FailureState {
+	failure, err := a.Store.FetchFailure(cert.Name)
+	if errors.Is(err, store.ErrNotFoundFailure) {
+		return nil
+	} else if err != nil {
+		siteLogger.WithError(err).Warn("error on fetch failure state")
+		return nil
+	}
+	if failure.ConfigHash == "" || failure.ConfigHash == configHash || failure.RateLimited {
+		return failure
+	}
+	siteLogger.WithField("failures", failure.Count).Info("Retry because the site config has changed since the last failure.")
+	err = a.Store.DeleteFailure(cert.Name)
+	if err != nil {
+		siteLogger.WithError(err).Warn("error on delete failure state")
+	}
+	return nil
+}
+
+// siteConfigHash identifies the config a certificate of the site is issued with, including the settings of its ca.
+func (a *AcmeService) siteConfigHash(site *common.Site) string {
+	caDir := a.caDir(site)
+	content, err := json.Marshal(struct {
+		Site  *common.Site
+		CaDir string
+		Eab   *common.ExternalAccountBinding
+	}{site, caDir, a.SitesConfig().ExternalAccountBinding(site, caDir)})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// nextFailure returns the failure state after the attempt failed with err.
+func (a *AcmeService) nextFailure(previous *store.FailureState, err error) *store.FailureState {
+	now := time.Now()
+	failure := &store.FailureState{
+		Count:       1,
+		LastError:   err.Error(),
+		LastAttempt: now,
+	}
+	if previous != nil {
+		failure.Count = previous.Count + 1
+	}
+
+	delay := backoff(failure.Count, a.Config.BackoffBase, a.Config.BackoffMax)
+	var rateLimited *RateLimitedError
+	if errors.As(err, &rateLimited) {
+		failure.RateLimited = true
+		if rateLimited.RetryAfter.After(now) {
+			delay = rateLimited.RetryAfter.Sub(now)
+		} else if delay < minRateLimitedBackoff {
+			delay = minRateLimitedBackoff
+		}
+	}
+	failure.NextAttempt = now.Add(delay)
+	return failure
+}
+
+// backoff returns the exponential backoff of the attempt count, with a jitter of ±20%.
+func backoff(count int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < count && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	jitter := time.Duration((rand.Float64()*0.4 - 0.2) * float64(delay))
+	return delay + jitter
+}
+
+var _ http.RoundTripper = &retryAfterTransport{}
+
+// retryAfterTransport records the Retry-After header of rateLimited responses,
+// which lego does not return with the error.
+type retryAfterTransport struct {
+	base http.RoundTripper
+
+	mutex      sync.Mutex
+	retryAfter time.Time
+}
+
+func (r *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.base.RoundTrip(req)
+	if err != nil || resp.StatusCode < http.StatusBadRequest {
+		return resp, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	problem := new(acme.ProblemDetails)
+	if json.Unmarshal(body, problem) != nil || problem.Type != rateLimitedErr {
+		return resp, nil
+	}
+	retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"))
+	if ok {
+		r.mutex.Lock()
+		if retryAfter.After(r.retryAfter) {
+			r.retryAfter = retryAfter
+		}
+		r.mutex.Unlock()
+	}
+	return resp, nil
+}
+
+// wrapError returns RateLimitedError if err is caused by the rate limit of the CA.
+func (r *retryAfterTransport) wrapError(err error) error {
+	if err == nil || !isRateLimited(err) {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return &RateLimitedError{
+		RetryAfter: r.retryAfter,
+		Err:        err,
+	}
+}
+
+func parseRetryAfter(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Now().Add(time.Duration(seconds) * time.Second), true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date, true
+	}
+	return time.Time{}, false
+}
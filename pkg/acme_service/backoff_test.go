@@ -0,0 +1,86 @@
+package acme_service
+
+import (
+	"errors"
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store/file_store"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	delay := backoff(1, time.Minute, time.Hour)
+	assert.InDelta(float64(time.Minute), float64(delay), float64(12*time.Second))
+	delay = backoff(3, time.Minute, time.Hour)
+	assert.InDelta(float64(4*time.Minute), float64(delay), float64(48*time.Second))
+	delay = backoff(20, time.Minute, time.Hour)
+	assert.InDelta(float64(time.Hour), float64(delay), float64(12*time.Minute))
+}
+
+func TestNextFailure(t *testing.T) {
+	assert := assert.New(t)
+	service := &AcmeService{Config: &AcmeProcessConfig{BackoffBase: time.Minute, BackoffMax: time.Hour}}
+
+	failure := service.nextFailure(nil, errors.New("timeout"))
+	assert.Equal(1, failure.Count)
+	assert.False(failure.RateLimited)
+
+	failure = service.nextFailure(&store.FailureState{Count: 2}, errors.New("timeout"))
+	assert.Equal(3, failure.Count)
+
+	retryAfter := &retryAfterTransport{retryAfter: time.Now().Add(3 * time.Hour)}
+	err := retryAfter.wrapError(&acme.ProblemDetails{Type: rateLimitedErr, HTTPStatus: http.StatusTooManyRequests})
+	failure = service.nextFailure(nil, err)
+	assert.True(failure.RateLimited)
+	assert.WithinDuration(retryAfter.retryAfter, failure.NextAttempt, time.Second)
+
+	err = (&retryAfterTransport{}).wrapError(errors.New("acme: error: 429 :: POST :: " + rateLimitedErr + " :: too many certificates"))
+	failure = service.nextFailure(nil, err)
+	assert.True(failure.RateLimited)
+	assert.True(failure.NextAttempt.After(time.Now().Add(minRateLimitedBackoff - time.Second)))
+}
+
+func TestFetchFailure(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "acme-failure")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	fileStore, err := file_store.NewFileStore(dir)
+	require.Nil(err)
+
+	broken := &common.Site{Name: "www", Provider: "rfc2136", Domains: []string{"www.example.com"}}
+	fixed := &common.Site{Name: "www", Provider: "rfc2136", Domains: []string{"www.example.com"}, LegoEnv: []string{"RFC2136_NAMESERVER=ns.example.com"}}
+	service := NewAcmeService(&AcmeProcessConfig{}, &common.SitesConfig{Sites: []*common.Site{broken}}, fileStore, logrus.New())
+	logger := service.logger
+	cert := broken.Certificates()[0]
+
+	brokenHash := service.siteConfigHash(broken)
+	assert.NotEqual(brokenHash, service.siteConfigHash(fixed))
+	assert.Nil(service.fetchFailure(logger, cert, brokenHash))
+
+	failure := &store.FailureState{Count: 3, NextAttempt: time.Now().Add(time.Hour), ConfigHash: brokenHash}
+	require.Nil(fileStore.WriteFailure(cert.Name, failure))
+	assert.NotNil(service.fetchFailure(logger, cert, brokenHash))
+
+	// the failure of the broken config is dropped once the site is fixed
+	assert.Nil(service.fetchFailure(logger, cert, service.siteConfigHash(fixed)))
+	_, err = fileStore.FetchFailure(cert.Name)
+	assert.Equal(store.ErrNotFoundFailure, err)
+
+	// rate limits of the ca are kept
+	failure.RateLimited = true
+	require.Nil(fileStore.WriteFailure(cert.Name, failure))
+	assert.NotNil(service.fetchFailure(logger, cert, service.siteConfigHash(fixed)))
+}
@@ -0,0 +1,176 @@
+package acme_service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"time"
+)
+
+var caaForbiddenGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: common.PrometheusNamespace,
+	Name:      "caa_forbidden",
+	Help:      "1 while the CAA records of a domain of the site forbid the ca",
+}, []string{"site"})
+
+var ErrCaaForbidden = errors.New("caa records forbid the ca")
+
+// deleteCaaForbidden deletes the caa_forbidden series of the sites removed from the config on reload.
+func deleteCaaForbidden(previous, current *common.SitesConfig) {
+	if previous == nil {
+		return
+	}
+	names := map[string]bool{}
+	for _, site := range current.Sites {
+		names[site.Name] = true
+	}
+	for _, site := range previous.Sites {
+		if !names[site.Name] {
+			caaForbiddenGauge.DeleteLabelValues(site.Name)
+		}
+	}
+}
+
+// caaChecker looks up the CAA records of the domains with the resolver, see RFC 8659.
+type caaChecker struct {
+	resolver string
+	client   *dns.Client
+}
+
+// newCaaChecker creates the checker with the resolver address. The resolver of /etc/resolv.conf is used when it is empty.
+func newCaaChecker(resolver string) (*caaChecker, error) {
+	if resolver == "" {
+		config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, fmt.Errorf("error read resolv.conf %w", err)
+		}
+		if len(config.Servers) == 0 {
+			return nil, errors.New("no nameserver in resolv.conf")
+		}
+		resolver = net.JoinHostPort(config.Servers[0], config.Port)
+	} else if _, _, err := net.SplitHostPort(resolver); err != nil {
+		resolver = net.JoinHostPort(resolver, "53")
+	}
+	return &caaChecker{
+		resolver: resolver,
+		client:   &dns.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (c *caaChecker) lookup(name string) ([]*dns.CAA, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeCAA)
+	m.SetEdns0(4096, false)
+	reply, _, err := c.client.Exchange(m, c.resolver)
+	if err == nil && reply.Truncated {
+		tcp := &dns.Client{Net: "tcp", Timeout: c.client.Timeout}
+		reply, _, err = tcp.Exchange(m, c.resolver)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("caa lookup of %s failed: %s", name, dns.RcodeToString[reply.Rcode])
+	}
+
+	// CNAMEs are followed by the resolver
+	var records []*dns.CAA
+	for _, rr := range reply.Answer {
+		if caa, ok := rr.(*dns.CAA); ok {
+			records = append(records, caa)
+		}
+	}
+	return records, nil
+}
+
+// relevantRecords returns the relevant CAA record set of the domain,
+// the records of the closest name while climbing up the tree from the domain.
+func (c *caaChecker) relevantRecords(domain string) ([]*dns.CAA, error) {
+	labels := dns.SplitDomainName(strings.TrimPrefix(domain, "*."))
+	for i := range labels {
+		records, err := c.lookup(strings.Join(labels[i:], "."))
+		if err != nil {
+			return nil, err
+		}
+		if len(records) != 0 {
+			return records, nil
+		}
+	}
+	return nil, nil
+}
+
+// caaAllows reports whether the record set allows one of the issuer domain names of the ca to issue for the domain.
+func caaAllows(records []*dns.CAA, identities []string, wildcard bool) bool {
+	var issue, issueWild []*dns.CAA
+	for _, record := range records {
+		switch strings.ToLower(record.Tag) {
+		case "issue":
+			issue = append(issue, record)
+		case "issuewild":
+			issueWild = append(issueWild, record)
+		case "iodef", "contactemail", "contactphone", "issuemail", "issuevmc":
+		default:
+			// unknown properties with the critical flag must not be ignored
+			if record.Flag&128 != 0 {
+				return false
+			}
+		}
+	}
+
+	// issuewild replaces issue for wildcard domains
+	relevant := issue
+	if wildcard && len(issueWild) != 0 {
+		relevant = issueWild
+	}
+	if len(relevant) == 0 {
+		return true
+	}
+	for _, record := range relevant {
+		issuer := strings.TrimSpace(strings.SplitN(record.Value, ";", 2)[0])
+		for _, identity := range identities {
+			if issuer != "" && strings.EqualFold(issuer, identity) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkCaa checks the CAA records of the domains of the site before the order,
+// so that the ca forbidden by them is reported clearly. Domains which can not be looked up are left to the ca.
+func (a *AcmeService) checkCaa(siteLogger *logrus.Entry, site *common.Site, dir *directory) error {
+	if len(dir.Meta.CaaIdentities) == 0 {
+		siteLogger.Debug("skip caa check because the ca has no caa identities")
+		return nil
+	}
+	checker, err := newCaaChecker(a.Config.CaaResolver)
+	if err != nil {
+		siteLogger.WithError(err).Warn("skip caa check")
+		return nil
+	}
+
+	var forbidden []string
+	for _, domain := range site.Domains {
+		records, err := checker.relevantRecords(domain)
+		if err != nil {
+			siteLogger.WithError(err).WithField("domain", domain).Warn("error on caa lookup")
+			continue
+		}
+		if !caaAllows(records, dir.Meta.CaaIdentities, strings.HasPrefix(domain, "*.")) {
+			forbidden = append(forbidden, domain)
+		}
+	}
+	if len(forbidden) != 0 {
+		caaForbiddenGauge.WithLabelValues(site.Name).Set(1)
+		siteLogger.WithField("domains", forbidden).WithField("caa_identities", dir.Meta.CaaIdentities).Error("caa records forbid the ca")
+		return fmt.Errorf("%w %s for %s", ErrCaaForbidden, strings.Join(dir.Meta.CaaIdentities, ","), strings.Join(forbidden, ","))
+	}
+	caaForbiddenGauge.WithLabelValues(site.Name).Set(0)
+	return nil
+}
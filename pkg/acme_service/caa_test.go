@@ -0,0 +1,47 @@
+package acme_service
+
+import (
+	"errors"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/dnstest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCheckCaa(t *testing.T) {
+	assert := assert.New(t)
+
+	resolver := dnstest.StartZoneServer(t,
+		`example.com. 300 IN CAA 0 issue "letsencrypt.org"`,
+		`example.com. 300 IN CAA 0 issuewild ";"`,
+		`other.example.com. 300 IN CAA 0 issue "pki.goog; cansignhttpexchanges=yes"`,
+		`critical.example.net. 300 IN CAA 128 unknown "value"`,
+	)
+	sites := &common.SitesConfig{Sites: []*common.Site{{Name: "example"}, {Name: "other"}}}
+	service := NewAcmeService(&AcmeProcessConfig{CaaResolver: resolver}, sites, nil, logrus.New())
+	logger := logrus.NewEntry(logrus.New())
+	dir := &directory{}
+	dir.Meta.CaaIdentities = []string{"letsencrypt.org"}
+
+	check := func(domains ...string) error {
+		return service.checkCaa(logger, &common.Site{Name: "example", Domains: domains}, dir)
+	}
+	// the records of the parent domain are relevant
+	assert.Nil(check("example.com", "www.example.com"))
+	assert.True(errors.Is(check("other.example.com"), ErrCaaForbidden))
+	assert.True(errors.Is(check("*.example.com"), ErrCaaForbidden))
+	assert.True(errors.Is(check("critical.example.net"), ErrCaaForbidden))
+	// no records do not restrict the ca
+	assert.Nil(check("example.org", "*.example.org"))
+
+	dir.Meta.CaaIdentities = []string{"pki.goog"}
+	assert.Nil(check("www.other.example.com"))
+
+	// the series of a removed site is deleted on reload
+	assert.Nil(service.checkCaa(logger, &common.Site{Name: "other", Domains: []string{"example.org"}}, dir))
+	assert.Equal(2, testutil.CollectAndCount(caaForbiddenGauge))
+	service.UpdateSitesConfig(&common.SitesConfig{Sites: []*common.Site{{Name: "other"}}})
+	assert.Equal(1, testutil.CollectAndCount(caaForbiddenGauge))
+}
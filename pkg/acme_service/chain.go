@@ -0,0 +1,199 @@
+package acme_service
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// hasPreferredChain reports whether a certificate of the issuer bundle is issued by the preferred common name.
+// It is the same rule as lego uses when the certificate is obtained.
+func hasPreferredChain(issuer []byte, preferredChain string) bool {
+	certs, err := certcrypto.ParsePEMBundle(issuer)
+	if err != nil {
+		return false
+	}
+	for _, cert := range certs {
+		if cert.Issuer.CommonName == preferredChain {
+			return true
+		}
+	}
+	return false
+}
+
+// chainIssuer returns the issuer common name of the last certificate of the issuer bundle, which identifies the chain.
+func chainIssuer(issuer []byte) string {
+	certs, err := certcrypto.ParsePEMBundle(issuer)
+	if err != nil || len(certs) == 0 {
+		return ""
+	}
+	return certs[len(certs)-1].Issuer.CommonName
+}
+
+// splitChain splits the PEM chain downloaded from the ca into the leaf and the issuer bundle.
+func splitChain(chain []byte) ([]byte, []byte, error) {
+	certs, err := certcrypto.ParsePEMBundle(chain)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(certs) < 2 {
+		return nil, nil, errors.New("chain has no issuer certificate")
+	}
+	issuer := bytes.Buffer{}
+	for _, cert := range certs[1:] {
+		err = pem.Encode(&issuer, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certs[0].Raw}), issuer.Bytes(), nil
+}
+
+// selectChain downloads the alternate chains of the stored certificate and stores the preferred one,
+// so that a changed preferred_chain is applied without issuing the certificate again.
+func (a *AcmeService) selectChain(siteLogger *logrus.Entry, account *store.Account, caDir string, name string, resource *store.Certificates, preferredChain string) error {
+	if resource.CertURL == "" {
+		return errors.New("certificate url is not stored")
+	}
+	if account.Registration == nil || account.Registration.URI == "" {
+		return errors.New("account is not registered")
+	}
+	dir, err := fetchDirectory(a.httpClient, caDir)
+	if err != nil {
+		return err
+	}
+
+	links := []string{resource.CertURL}
+	for i := 0; i < len(links); i++ {
+		resp, body, err := a.postAsGet(account, dir, links[i])
+		if err != nil {
+			return fmt.Errorf("error download chain %s %w", links[i], err)
+		}
+		if i == 0 {
+			links = append(links, parseLinks(resp.Header, "alternate")...)
+		}
+
+		leaf, issuer, err := splitChain(body)
+		if err != nil {
+			return fmt.Errorf("error parse chain %s %w", links[i], err)
+		}
+		if preferredChain != "" && !hasPreferredChain(issuer, preferredChain) {
+			continue
+		}
+		resource.Certificate = append(leaf, issuer...)
+		resource.IssuerCertificate = issuer
+		resource.CertURL = links[i]
+		resource.CertStableURL = links[i]
+		resource.PreferredChain = preferredChain
+		resource.ChainIssuer = chainIssuer(issuer)
+		siteLogger.WithField("preferred_chain", preferredChain).WithField("chain_issuer", resource.ChainIssuer).Info("select chain")
+		return a.Store.WriteResource(name, resource)
+	}
+
+	siteLogger.WithField("preferred_chain", preferredChain).WithField("chain_issuer", resource.ChainIssuer).Warn("no chain of the ca matches the preferred chain, keep the current chain")
+	resource.PreferredChain = preferredChain
+	return a.Store.WriteResource(name, resource)
+}
+
+// postAsGet fetches the resource with the POST-as-GET request signed by the account key. See RFC 8555 section 6.3.
+func (a *AcmeService) postAsGet(account *store.Account, dir *directory, url string) (*http.Response, []byte, error) {
+	nonceResp, err := a.httpClient.Head(dir.NewNonceURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonceResp.Body.Close()
+	nonce := nonceResp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return nil, nil, errors.New("no nonce from the ca")
+	}
+
+	privateKey := account.GetPrivateKey()
+	alg, err := jwsAlgorithm(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	protectedBytes, err := json.Marshal(map[string]string{
+		"alg":   alg,
+		"kid":   account.Registration.URI,
+		"nonce": nonce,
+		"url":   url,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	jws := &flattenedJws{
+		Protected: base64.RawURLEncoding.EncodeToString(protectedBytes),
+	}
+	jws.Signature, err = signJws(privateKey, jws.Protected, jws.Payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := json.Marshal(jws)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := a.httpClient.Post(url, "application/jose+json", bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(respBody))
+	}
+	return resp, respBody, nil
+}
+
+// parseLinks returns the urls of the Link headers with the relation.
+func parseLinks(header http.Header, rel string) []string {
+	var links []string
+	for _, value := range header.Values("Link") {
+		for _, link := range strings.Split(value, ",") {
+			parts := strings.Split(link, ";")
+			url := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(url, "<") || !strings.HasSuffix(url, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				param = strings.ReplaceAll(strings.TrimSpace(param), " ", "")
+				if param == `rel="`+rel+`"` || param == "rel="+rel {
+					links = append(links, strings.Trim(url, "<>"))
+				}
+			}
+		}
+	}
+	return links
+}
+
+// jwsAlgorithm returns the JWS algorithm lego uses for the account key.
+func jwsAlgorithm(privateKey crypto.PrivateKey) (string, error) {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return "RS256", nil
+	case *ecdsa.PrivateKey:
+		switch key.Curve.Params().BitSize {
+		case 256:
+			return "ES256", nil
+		case 384:
+			return "ES384", nil
+		}
+		return "", fmt.Errorf("unsupported curve %s", key.Curve.Params().Name)
+	}
+	return "", fmt.Errorf("unsupported account key type %T", privateKey)
+}
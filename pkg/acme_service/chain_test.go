@@ -0,0 +1,129 @@
+package acme_service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store/file_store"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// signCert creates a certificate of the public key signed by the parent, which is self-signed when parent is nil.
+func signCert(t *testing.T, commonName string, key *ecdsa.PrivateKey, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  parent == nil || commonName != "example.com",
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return cert
+}
+
+func encodeChain(certs ...*x509.Certificate) []byte {
+	var chain []byte
+	for _, cert := range certs {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return chain
+}
+
+func TestParseLinks(t *testing.T) {
+	header := http.Header{}
+	header.Add("Link", `<https://ca/directory>;rel="index"`)
+	header.Add("Link", `<https://ca/cert/1/1>; rel="alternate", <https://ca/cert/1/2>;rel=alternate`)
+	assert.Equal(t, []string{"https://ca/cert/1/1", "https://ca/cert/1/2"}, parseLinks(header, "alternate"))
+}
+
+func TestSelectChain(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.Nil(err)
+		return key
+	}
+	rootKey, crossKey, intermediateKey, leafKey := newKey(), newKey(), newKey(), newKey()
+	root := signCert(t, "Root X1", rootKey, nil, nil)
+	cross := signCert(t, "Root X1", rootKey, signCert(t, "Old Root", crossKey, nil, nil), crossKey)
+	intermediate := signCert(t, "R3", intermediateKey, root, rootKey)
+	leaf := signCert(t, "example.com", leafKey, intermediate, intermediateKey)
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"newNonce": "%s/new-nonce", "newOrder": "%s/new-order"}`, server.URL, server.URL)
+	})
+	mux.HandleFunc("/new-nonce", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+	})
+	mux.HandleFunc("/cert/1", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(http.MethodPost, r.Method)
+		w.Header().Add("Link", fmt.Sprintf(`<%s/cert/1/1>;rel="alternate"`, server.URL))
+		w.Write(encodeChain(leaf, intermediate))
+	})
+	mux.HandleFunc("/cert/1/1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(encodeChain(leaf, intermediate, cross))
+	})
+
+	dir, err := ioutil.TempDir("", "envoy-acme-test")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	fileStore, err := file_store.NewFileStore(dir)
+	require.Nil(err)
+	service := NewAcmeService(&AcmeProcessConfig{}, nil, fileStore, logrus.New())
+	service.httpClient = server.Client()
+
+	account := store.NewAccount("test@example.com", newKey())
+	account.Registration = &registration.Resource{URI: server.URL + "/account/1"}
+	resource := &store.Certificates{
+		CertURL:           server.URL + "/cert/1",
+		Certificate:       encodeChain(leaf, intermediate),
+		IssuerCertificate: encodeChain(intermediate),
+	}
+	assert.Equal("Root X1", chainIssuer(resource.IssuerCertificate))
+
+	err = service.selectChain(logrus.NewEntry(logrus.New()), account, server.URL+"/directory", "example", resource, "Old Root")
+	require.Nil(err)
+	stored, err := fileStore.FetchResource("example")
+	require.Nil(err)
+	assert.Equal(server.URL+"/cert/1/1", stored.CertURL)
+	assert.Equal("Old Root", stored.PreferredChain)
+	assert.Equal("Old Root", stored.ChainIssuer)
+	assert.Equal(encodeChain(intermediate, cross), stored.IssuerCertificate)
+	assert.Equal(encodeChain(leaf, intermediate, cross), stored.Certificate)
+
+	// the current chain is kept when nothing matches
+	err = service.selectChain(logrus.NewEntry(logrus.New()), account, server.URL+"/directory", "example", stored, "Unknown Root")
+	require.Nil(err)
+	stored, err = fileStore.FetchResource("example")
+	require.Nil(err)
+	assert.Equal("Unknown Root", stored.PreferredChain)
+	assert.Equal("Old Root", stored.ChainIssuer)
+}
@@ -0,0 +1,34 @@
+package acme_service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/dns_provider"
+	"github.com/sirupsen/logrus"
+)
+
+var ErrChallengeNotDelegated = errors.New("challenge is not delegated to the alias")
+
+// checkChallengeAliases checks that the challenge of every domain with challenge_alias is a CNAME of the alias
+// before the order, because the provider can write only the alias zone.
+func checkChallengeAliases(siteLogger *logrus.Entry, site *common.Site, resolver *dns_provider.Resolver) error {
+	for _, dp := range site.DNSProviders() {
+		if dp.ChallengeAlias == "" {
+			continue
+		}
+		alias := dns_provider.ChallengeName(dp.ChallengeAlias)
+		for _, domain := range dp.Domains {
+			name := dns_provider.ChallengeName(domain)
+			target, err := resolver.ResolveCNAME(name)
+			if err != nil {
+				return fmt.Errorf("error on lookup cname of %s %w", name, err)
+			}
+			if target != alias {
+				return fmt.Errorf("%w: %s must be a cname of %s, but resolves to %s", ErrChallengeNotDelegated, name, alias, target)
+			}
+			siteLogger.WithField("domain", domain).WithField("alias", alias).Debug("challenge is delegated")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package acme_service
+
+import (
+	"errors"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/dns_provider"
+	"github.com/kamijin-fanta/envoy-acme/pkg/dnstest"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCheckChallengeAliases(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	resolver, err := dns_provider.NewResolver([]string{dnstest.StartZoneServer(t,
+		`_acme-challenge.example.com. 60 IN CNAME _acme-challenge.validation.example.net.`,
+		`_acme-challenge.www.example.com. 60 IN CNAME _acme-challenge.validation.example.net.`,
+		`_acme-challenge.example.org. 60 IN CNAME _acme-challenge.other.example.net.`,
+	)})
+	require.Nil(err)
+	logger := logrus.NewEntry(logrus.New())
+
+	check := func(domains ...string) error {
+		site := &common.Site{Name: "example", Provider: "rfc2136", Domains: domains, ChallengeAlias: "validation.example.net"}
+		return checkChallengeAliases(logger, site, resolver)
+	}
+	assert.Nil(check("example.com", "*.example.com", "www.example.com"))
+	assert.True(errors.Is(check("example.org"), ErrChallengeNotDelegated))
+	// the cname is not created yet
+	assert.True(errors.Is(check("example.io"), ErrChallengeNotDelegated))
+}
@@ -0,0 +1,76 @@
+package acme_service
+
+import (
+	"fmt"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/dns01_service"
+	"github.com/kamijin-fanta/envoy-acme/pkg/dns_provider"
+)
+
+// siteDNSProvider creates the DNS providers of the site, each with its own credentials,
+// and dispatches the challenge of every domain to its provider, following the delegations with CNAMEs.
+func (a *AcmeService) siteDNSProvider(site *common.Site, resolver *dns_provider.Resolver) (challenge.Provider, error) {
+	domains := map[string]*dns_provider.ChallengeDomain{}
+	for _, dp := range site.DNSProviders() {
+		env, err := dns_provider.ParseEnv(dp.LegoEnv)
+		if err != nil {
+			return nil, fmt.Errorf("error on parse legoenv %w", err)
+		}
+		var provider challenge.Provider
+		if dp.Provider == dns_provider.Embedded {
+			provider = dns01_service.NewProvider(a.Store)
+		} else {
+			provider, err = dns_provider.NewDNSProvider(dp.Provider, env)
+			if err != nil {
+				return nil, fmt.Errorf("error on new provider %w", err)
+			}
+		}
+		cd := &dns_provider.ChallengeDomain{
+			Provider: provider,
+			Alias:    dp.ChallengeAlias,
+		}
+		if dns_provider.SupportsRecords(dp.Provider) {
+			cd.Records, err = dns_provider.NewRecordWriter(dp.Provider, env)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, domain := range dp.Domains {
+			domains[domain] = cd
+		}
+	}
+	return dns_provider.NewDomainProviders(domains, resolver), nil
+}
+
+// siteResolver creates the resolver of the propagation nameservers of the site, or of /etc/resolv.conf.
+func siteResolver(site *common.Site) (*dns_provider.Resolver, error) {
+	var nameservers []string
+	if site.Propagation != nil {
+		nameservers = site.Propagation.Nameservers
+	}
+	resolver, err := dns_provider.NewResolver(nameservers)
+	if err != nil {
+		return nil, fmt.Errorf("error on new resolver %w", err)
+	}
+	return resolver, nil
+}
+
+// siteRecordWriter creates the record writers of the site, and dispatches the records to the provider of their domain.
+func siteRecordWriter(site *common.Site) (dns_provider.RecordWriter, error) {
+	writers := map[string]dns_provider.RecordWriter{}
+	for _, dp := range site.DNSProviders() {
+		env, err := dns_provider.ParseEnv(dp.LegoEnv)
+		if err != nil {
+			return nil, fmt.Errorf("error on parse legoenv %w", err)
+		}
+		writer, err := dns_provider.NewRecordWriter(dp.Provider, env)
+		if err != nil {
+			return nil, err
+		}
+		for _, domain := range dp.Domains {
+			writers[domain] = writer
+		}
+	}
+	return dns_provider.NewDomainRecordWriters(writers), nil
+}
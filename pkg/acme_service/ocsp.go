@@ -0,0 +1,279 @@
+package acme_service
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+var (
+	ocspUpdatedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: common.PrometheusNamespace,
+		Name:      "ocsp_updated",
+	})
+	ocspFailedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: common.PrometheusNamespace,
+		Name:      "ocsp_failed",
+	})
+)
+
+const (
+	// OcspResponderFailureWarn keeps the last valid response until it expires when the responder is unreachable.
+	OcspResponderFailureWarn = "warn"
+	// OcspResponderFailureFail stops the process when the responder is unreachable and no valid response is left.
+	OcspResponderFailureFail = "fail"
+)
+
+// ocspRefreshMargin is how long before the nextUpdate of a response it is refreshed at the latest
+const ocspRefreshMargin = time.Hour
+
+// ErrOcspStapleExpired is returned when the responder failed and the certificate has no valid response to staple.
+var ErrOcspStapleExpired = errors.New("no valid ocsp response")
+
+// StartOcspRefresher fetches the OCSP responses of the certificates every Config.OcspInterval, or earlier when a
+// response is due before, and publishes them as the ocsp_staple of the secrets.
+// With OcspResponderFailureFail, the refresher stops and sends the error when a certificate has no valid response left,
+// so that the process can shut down.
+func (a *AcmeService) StartOcspRefresher() <-chan error {
+	errCh := make(chan error, 1)
+	if a.Config.OcspInterval <= 0 {
+		return errCh
+	}
+	go func() {
+		for {
+			updated, next, err := a.refreshOcspAll()
+			if updated {
+				a.FireNotification()
+			}
+			if err != nil {
+				errCh <- err
+				return
+			}
+
+			// wait for timer, or a certificate issued
+			wait := a.Config.OcspInterval
+			if !next.IsZero() && time.Until(next) < wait {
+				wait = time.Until(next)
+			}
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-a.ocspWakeup:
+				t.Stop()
+			}
+		}
+	}()
+	return errCh
+}
+
+// wakeupOcspRefresher refreshes the responses soon, e.g. to staple a certificate just issued.
+func (a *AcmeService) wakeupOcspRefresher() {
+	select {
+	case a.ocspWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// refreshOcspAll refreshes the responses of every certificate, and returns whether one of them has changed
+// and the earliest time a response is due.
+// An error is returned when a certificate has no valid response left with OcspResponderFailureFail.
+func (a *AcmeService) refreshOcspAll() (bool, time.Time, error) {
+	updated := false
+	var earliest time.Time
+	for _, cert := range a.SitesConfig().Certificates() {
+		siteLogger := a.logger.WithField("site", cert.Name)
+		changed, next, err := a.refreshOcsp(cert.Name)
+		if changed {
+			updated = true
+		}
+		if !next.IsZero() && (earliest.IsZero() || next.Before(earliest)) {
+			earliest = next
+		}
+		if err == nil {
+			continue
+		}
+		ocspFailedCounter.Inc()
+		if errors.Is(err, ErrOcspStapleExpired) && a.Config.OcspResponderFailure == OcspResponderFailureFail {
+			return updated, earliest, fmt.Errorf("ocsp responder failed for %s %w", cert.Name, err)
+		}
+		siteLogger.WithError(err).Warn("error on refresh ocsp response")
+	}
+	return updated, earliest, nil
+}
+
+// refreshOcsp fetches the OCSP response of the certificate when the stored one is missing or due by ocspRefreshTime.
+// It returns whether the stored response has changed, and the time the response is due next, which is zero when
+// the certificate is only checked again after Config.OcspInterval.
+func (a *AcmeService) refreshOcsp(name string) (bool, time.Time, error) {
+	siteLogger := a.logger.WithField("site", name)
+
+	// the response is refreshed after the renewal running in this instance, which staples the new certificate
+	if !a.certLocks.tryLock(name) {
+		siteLogger.Debug("Skip ocsp because the certificate is being renewed.")
+		return false, time.Time{}, nil
+	}
+	defer a.certLocks.unlock(name)
+	// the lock of the renewal, so that a certificate is not replaced by another instance while its response is written
+	ok, err := a.Store.Lock(name, a.Config.InstanceId, a.Config.LockTimeout)
+	if err != nil {
+		return false, time.Time{}, fmt.Errorf("lock error %w", err)
+	}
+	if !ok {
+		siteLogger.Debug("Skip ocsp because the certificate is locked.")
+		return false, time.Time{}, nil
+	}
+	defer a.Store.Release(name, a.Config.InstanceId)
+
+	resource, err := a.Store.FetchResource(name)
+	if errors.Is(err, store.ErrNotFoundCertificate) {
+		return false, time.Time{}, nil
+	} else if err != nil {
+		return false, time.Time{}, fmt.Errorf("fetch resource error %w", err)
+	}
+	leaf, issuer, err := leafAndIssuer(resource)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	if len(leaf.OCSPServer) == 0 {
+		// the ca has dropped OCSP
+		siteLogger.Debug("certificate has no ocsp responder")
+		changed, err := a.writeOcspStaple(name, resource, nil)
+		return changed, time.Time{}, err
+	}
+
+	now := time.Now()
+	var current *ocsp.Response
+	if len(resource.OcspStaple) != 0 {
+		current, err = ocsp.ParseResponseForCert(resource.OcspStaple, leaf, issuer)
+		if err == nil && now.Before(ocspRefreshTime(current)) {
+			return false, ocspRefreshTime(current), nil
+		}
+	}
+
+	response, raw, err := fetchOcsp(a.httpClient, leaf.OCSPServer[0], leaf, issuer)
+	var responseErr ocsp.ResponseError
+	if errors.As(err, &responseErr) && responseErr.Status == ocsp.Unauthorized {
+		// the responder no longer answers for the ca
+		siteLogger.WithError(err).Info("ocsp responder does not serve the certificate")
+		changed, err := a.writeOcspStaple(name, resource, nil)
+		return changed, time.Time{}, err
+	}
+	if err != nil {
+		if current != nil && current.NextUpdate.IsZero() {
+			return false, time.Time{}, err
+		}
+		if current != nil && now.Before(current.NextUpdate) {
+			// retried every interval, and dropped at the nextUpdate when the responder is still down
+			return false, current.NextUpdate, err
+		}
+		changed, writeErr := a.writeOcspStaple(name, resource, nil)
+		if writeErr != nil {
+			return changed, time.Time{}, writeErr
+		}
+		return changed, time.Time{}, fmt.Errorf("%w: %v", ErrOcspStapleExpired, err)
+	}
+
+	switch response.Status {
+	case ocsp.Good:
+		siteLogger.WithField("next_update", response.NextUpdate.Format(time.RFC3339)).Info("ocsp response updated")
+		ocspUpdatedCounter.Inc()
+		changed, err := a.writeOcspStaple(name, resource, raw)
+		return changed, ocspRefreshTime(response), err
+	case ocsp.Revoked:
+		siteLogger.WithField("revoked_at", response.RevokedAt.Format(time.RFC3339)).Error("certificate is revoked")
+	default:
+		siteLogger.Warn("ocsp status of the certificate is unknown")
+	}
+	changed, err := a.writeOcspStaple(name, resource, nil)
+	return changed, time.Time{}, err
+}
+
+func (a *AcmeService) writeOcspStaple(name string, resource *store.Certificates, staple []byte) (bool, error) {
+	if bytes.Equal(resource.OcspStaple, staple) {
+		return false, nil
+	}
+	resource.OcspStaple = staple
+	err := a.Store.WriteResource(name, resource)
+	if err != nil {
+		return false, fmt.Errorf("write resource error %w", err)
+	}
+	return true, nil
+}
+
+// ocspRefreshTime returns the time at the half of the validity of the response, or ocspRefreshMargin before its
+// nextUpdate when that is earlier. Responses without nextUpdate are refreshed on every check.
+func ocspRefreshTime(response *ocsp.Response) time.Time {
+	if response.NextUpdate.IsZero() {
+		return time.Time{}
+	}
+	refresh := response.ThisUpdate.Add(response.NextUpdate.Sub(response.ThisUpdate) / 2)
+	if margin := response.NextUpdate.Add(-ocspRefreshMargin); margin.Before(refresh) {
+		return margin
+	}
+	return refresh
+}
+
+// validOcspStaple returns the staple unless it is past its nextUpdate, so that an expired response is never served
+// while the refresher has not dropped it from the store yet.
+func validOcspStaple(staple []byte, now time.Time) []byte {
+	if len(staple) == 0 {
+		return nil
+	}
+	response, err := ocsp.ParseResponse(staple, nil)
+	if err != nil || (!response.NextUpdate.IsZero() && !now.Before(response.NextUpdate)) {
+		return nil
+	}
+	return staple
+}
+
+func leafAndIssuer(resource *store.Certificates) (*x509.Certificate, *x509.Certificate, error) {
+	certs, err := resource.ExtractCertificate()
+	if err != nil {
+		return nil, nil, fmt.Errorf("extract certs error %w", err)
+	}
+	if len(certs) < 2 {
+		return nil, nil, errors.New("certificate has no issuer certificate")
+	}
+	return certs[0], certs[1], nil
+}
+
+// fetchOcsp requests the OCSP response of the certificate, and validates it with the issuer.
+func fetchOcsp(httpClient *http.Client, responder string, leaf, issuer *x509.Certificate) (*ocsp.Response, []byte, error) {
+	request, err := ocsp.CreateRequest(leaf, issuer, &ocsp.RequestOptions{Hash: crypto.SHA1})
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := httpClient.Post(responder, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status %d from ocsp responder %s", resp.StatusCode, responder)
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	response, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !response.NextUpdate.IsZero() && response.NextUpdate.Before(time.Now()) {
+		return nil, nil, fmt.Errorf("ocsp response expired at %s", response.NextUpdate.Format(time.RFC3339))
+	}
+	return response, raw, nil
+}
@@ -0,0 +1,166 @@
+package acme_service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store/file_store"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRefreshOcsp(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	issuerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(err)
+	issuer := signCert(t, "R3", issuerKey, nil, nil)
+
+	responderUp := true
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if !responderUp {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		require.Nil(err)
+		request, err := ocsp.ParseRequest(body)
+		require.Nil(err)
+		response, err := ocsp.CreateResponse(issuer, issuer, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Hour),
+			NextUpdate:   time.Now().Add(7 * 24 * time.Hour),
+		}, issuerKey)
+		require.Nil(err)
+		w.Write(response)
+	}))
+	defer server.Close()
+
+	issueLeaf := func(ocspServer []string) *store.Certificates {
+		leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.Nil(err)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: "example.com"},
+			DNSNames:     []string{"example.com"},
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+			OCSPServer:   ocspServer,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, issuer, &leafKey.PublicKey, issuerKey)
+		require.Nil(err)
+		leaf, err := x509.ParseCertificate(der)
+		require.Nil(err)
+		return &store.Certificates{
+			Certificate:       encodeChain(leaf, issuer),
+			IssuerCertificate: encodeChain(issuer),
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "envoy-acme-test")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	fileStore, err := file_store.NewFileStore(dir)
+	require.Nil(err)
+	service := NewAcmeService(&AcmeProcessConfig{InstanceId: "test", LockTimeout: time.Minute}, nil, fileStore, logrus.New())
+	service.httpClient = server.Client()
+
+	require.Nil(fileStore.WriteResource("example", issueLeaf([]string{server.URL})))
+	// skipped while the certificate is renewed in this instance
+	service.certLocks.lock("example")
+	changed, next, err := service.refreshOcsp("example")
+	require.Nil(err)
+	assert.False(changed)
+	assert.True(next.IsZero())
+	assert.Equal(0, requests)
+	service.certLocks.unlock("example")
+
+	changed, next, err = service.refreshOcsp("example")
+	require.Nil(err)
+	assert.True(changed)
+	// at the half of the validity
+	assert.WithinDuration(time.Now().Add(83*time.Hour+30*time.Minute), next, time.Minute)
+	stored, err := fileStore.FetchResource("example")
+	require.Nil(err)
+	assert.NotEmpty(stored.OcspStaple)
+
+	// the response is valid for days
+	changed, next, err = service.refreshOcsp("example")
+	require.Nil(err)
+	assert.False(changed)
+	assert.WithinDuration(time.Now().Add(83*time.Hour+30*time.Minute), next, time.Minute)
+	assert.Equal(1, requests)
+
+	// the response expired and the responder is down
+	responderUp = false
+	stored.OcspStaple = nil
+	require.Nil(fileStore.WriteResource("example", stored))
+	changed, _, err = service.refreshOcsp("example")
+	assert.False(changed)
+	assert.True(errors.Is(err, ErrOcspStapleExpired))
+
+	// the refresher stops with the error instead of exiting the process
+	service.Config.OcspInterval = time.Hour
+	service.Config.OcspResponderFailure = OcspResponderFailureFail
+	service.sitesConfig = &common.SitesConfig{Sites: []*common.Site{{Name: "example", Domains: []string{"example.com"}}}}
+	select {
+	case err = <-service.StartOcspRefresher():
+		assert.True(errors.Is(err, ErrOcspStapleExpired))
+	case <-time.After(5 * time.Second):
+		t.Fatal("ocsp refresher did not stop")
+	}
+
+	// the ca has dropped ocsp
+	require.Nil(fileStore.WriteResource("example", issueLeaf(nil)))
+	changed, _, err = service.refreshOcsp("example")
+	require.Nil(err)
+	assert.False(changed)
+	assert.Equal(3, requests)
+}
+
+func TestOcspStapleExpiry(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	issuerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(err)
+	issuer := signCert(t, "R3", issuerKey, nil, nil)
+	now := time.Now()
+	staple, err := ocsp.CreateResponse(issuer, issuer, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: big.NewInt(1),
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(4 * time.Hour),
+	}, issuerKey)
+	require.Nil(err)
+	response, err := ocsp.ParseResponse(staple, nil)
+	require.Nil(err)
+
+	// refreshed at the half of the validity, or the margin before the nextUpdate when it is earlier
+	assert.WithinDuration(response.ThisUpdate.Add(2*time.Hour), ocspRefreshTime(response), 0)
+	response.ThisUpdate = response.NextUpdate.Add(-time.Hour)
+	assert.WithinDuration(response.NextUpdate.Add(-ocspRefreshMargin), ocspRefreshTime(response), 0)
+
+	// the staple is dropped from the secret once it is past the nextUpdate
+	assert.Equal(staple, validOcspStaple(staple, now))
+	assert.Nil(validOcspStaple(staple, now.Add(5*time.Hour)))
+	assert.Nil(validOcspStaple(nil, now))
+}
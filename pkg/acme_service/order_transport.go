@@ -0,0 +1,211 @@
+package acme_service
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	alreadyReplacedErr = "urn:ietf:params:acme:error:alreadyReplaced"
+	malformedErr       = "urn:ietf:params:acme:error:malformed"
+)
+
+var _ http.RoundTripper = &orderTransport{}
+
+// orderTransport adds fields to the newOrder request which the bundled lego version can not send, e.g. "replaces".
+// The request is signed again with the account key after the payload has been changed.
+// When the ca rejects "replaces", e.g. because a failed order has already replaced the certificate,
+// the order is sent once more without it, so that the renewal does not fail until that order expires.
+type orderTransport struct {
+	base        http.RoundTripper
+	privateKey  crypto.PrivateKey
+	newOrderURL string
+	fields      map[string]interface{}
+	logger      *logrus.Entry
+}
+
+type flattenedJws struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+func (o *orderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(o.fields) == 0 || req.Method != http.MethodPost || req.URL.String() != o.newOrderURL || req.Body == nil {
+		return o.base.RoundTrip(req)
+	}
+
+	original, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	body, err := o.rewrite(original, o.fields, "")
+	if err != nil {
+		return nil, fmt.Errorf("error rewrite new order %w", err)
+	}
+	resp, err := o.base.RoundTrip(withBody(req, body))
+	if err != nil || o.fields["replaces"] == nil {
+		return resp, err
+	}
+
+	problem, err := readProblem(resp)
+	if err != nil {
+		return nil, err
+	}
+	nonce := resp.Header.Get("Replay-Nonce")
+	if problem == nil || !rejectsReplaces(problem) || nonce == "" {
+		return resp, nil
+	}
+	resp.Body.Close()
+	o.logger.WithField("type", problem.Type).WithField("detail", problem.Detail).Warn("ca rejected replaces, order again without it")
+
+	fields := map[string]interface{}{}
+	for key, value := range o.fields {
+		if key != "replaces" {
+			fields[key] = value
+		}
+	}
+	body, err = o.rewrite(original, fields, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("error rewrite new order %w", err)
+	}
+	return o.base.RoundTrip(withBody(req, body))
+}
+
+// rejectsReplaces reports whether the ca rejected the order because of the "replaces" field.
+func rejectsReplaces(problem *acme.ProblemDetails) bool {
+	return problem.Type == alreadyReplacedErr ||
+		(problem.Type == malformedErr && strings.Contains(strings.ToLower(problem.Detail), "replace"))
+}
+
+// readProblem returns the problem document of an error response, and keeps the body readable.
+func readProblem(resp *http.Response) (*acme.ProblemDetails, error) {
+	if resp.StatusCode < http.StatusBadRequest {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	problem := new(acme.ProblemDetails)
+	if json.Unmarshal(body, problem) != nil {
+		return nil, nil
+	}
+	return problem, nil
+}
+
+func withBody(req *http.Request, body []byte) *http.Request {
+	newReq := req.Clone(req.Context())
+	newReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	newReq.ContentLength = int64(len(body))
+	newReq.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return newReq
+}
+
+// rewrite adds the fields to the payload of the signed request, and replaces the nonce unless it is empty.
+func (o *orderTransport) rewrite(body []byte, fields map[string]interface{}, nonce string) ([]byte, error) {
+	jws := new(flattenedJws)
+	err := json.Unmarshal(body, jws)
+	if err != nil {
+		return nil, err
+	}
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return nil, err
+	}
+	payload := map[string]interface{}{}
+	err = json.Unmarshal(payloadBytes, &payload)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range fields {
+		payload[key] = value
+	}
+	payloadBytes, err = json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if nonce != "" {
+		protectedBytes, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+		if err != nil {
+			return nil, err
+		}
+		protected := map[string]interface{}{}
+		err = json.Unmarshal(protectedBytes, &protected)
+		if err != nil {
+			return nil, err
+		}
+		protected["nonce"] = nonce
+		protectedBytes, err = json.Marshal(protected)
+		if err != nil {
+			return nil, err
+		}
+		jws.Protected = base64.RawURLEncoding.EncodeToString(protectedBytes)
+	}
+
+	jws.Payload = base64.RawURLEncoding.EncodeToString(payloadBytes)
+	jws.Signature, err = signJws(o.privateKey, jws.Protected, jws.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jws)
+}
+
+// signJws signs the JWS with the same algorithm lego uses for the account key.
+func signJws(privateKey crypto.PrivateKey, protected, payload string) (string, error) {
+	signingInput := []byte(protected + "." + payload)
+
+	var signature []byte
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		digest := crypto.SHA256.New()
+		digest.Write(signingInput)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest.Sum(nil))
+		if err != nil {
+			return "", err
+		}
+		signature = sig
+	case *ecdsa.PrivateKey:
+		var hash crypto.Hash
+		switch key.Curve.Params().BitSize {
+		case 256:
+			hash = crypto.SHA256
+		case 384:
+			hash = crypto.SHA384
+		default:
+			return "", fmt.Errorf("unsupported curve %s", key.Curve.Params().Name)
+		}
+		digest := hash.New()
+		digest.Write(signingInput)
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest.Sum(nil))
+		if err != nil {
+			return "", err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	default:
+		return "", fmt.Errorf("unsupported account key type %T", privateKey)
+	}
+	return base64.RawURLEncoding.EncodeToString(signature), nil
+}
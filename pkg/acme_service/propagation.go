@@ -0,0 +1,39 @@
+package acme_service
+
+import (
+	"fmt"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/dns_provider"
+)
+
+// propagationOptions applies the propagation settings of the site to the provider and the dns-01 challenge.
+// The checks run on the resolvers of the site, so that the global resolvers of lego are never changed.
+func propagationOptions(site *common.Site, provider challenge.Provider) (challenge.Provider, []dns01.ChallengeOption, error) {
+	p := site.Propagation
+	if p == nil {
+		return provider, nil, nil
+	}
+
+	if wait := p.WaitDuration(); wait > 0 {
+		// lego sleeps for the interval before the first check, which always succeeds
+		provider = dns_provider.WithTimeout(provider, wait, wait)
+		return provider, []dns01.ChallengeOption{
+			dns01.WrapPreCheck(func(domain, fqdn, value string, check dns01.PreCheckFunc) (bool, error) {
+				return true, nil
+			}),
+		}, nil
+	}
+
+	checker, err := dns_provider.NewPropagationCheck(p.Nameservers, p.AuthoritativeCheck())
+	if err != nil {
+		return nil, nil, fmt.Errorf("error on propagation check %w", err)
+	}
+	provider = dns_provider.WithTimeout(provider, p.TimeoutDuration(), p.IntervalDuration())
+	return provider, []dns01.ChallengeOption{
+		dns01.WrapPreCheck(func(domain, fqdn, value string, check dns01.PreCheckFunc) (bool, error) {
+			return checker.Check(fqdn, value)
+		}),
+	}, nil
+}
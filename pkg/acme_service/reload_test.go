@@ -0,0 +1,51 @@
+package acme_service
+
+import (
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store/file_store"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestUpdateSitesConfig(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "acme-reload")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	fileStore, err := file_store.NewFileStore(dir)
+	require.Nil(err)
+	require.Nil(fileStore.WriteResource("a", &store.Certificates{Domain: "a.example.com"}))
+	require.Nil(fileStore.WriteResource("b", &store.Certificates{Domain: "b.example.com"}))
+
+	site := func(name string) *common.Site {
+		return &common.Site{Name: name, Provider: "rfc2136", Domains: []string{name + ".example.com"}}
+	}
+	service := NewAcmeService(&AcmeProcessConfig{}, &common.SitesConfig{Sites: []*common.Site{site("a"), site("b")}}, fileStore, logrus.New())
+	notify := func() *common.Notification {
+		go service.FireNotification()
+		return <-service.NotificationChannel()
+	}
+	certs := notify().Certificates
+	assert.Len(certs, 4)
+	// the secrets named after the first domain by earlier versions are kept
+	assert.Equal(certs["a"], certs["a.example.com"])
+
+	service.UpdateSitesConfig(&common.SitesConfig{Sites: []*common.Site{site("a")}})
+	service.UpdateSitesConfig(&common.SitesConfig{Sites: []*common.Site{site("a"), site("c")}})
+	assert.Len(service.SitesConfig().Sites, 2)
+	// the secret of the removed site is dropped
+	certs = notify().Certificates
+	assert.Len(certs, 2)
+	assert.Contains(certs, "a")
+	assert.Contains(certs, "a.example.com")
+
+	// the loop is woken up once for the reloads
+	assert.Len(service.reloadWakeup, 1)
+}
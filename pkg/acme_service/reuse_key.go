@@ -0,0 +1,72 @@
+package acme_service
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// certificateKey returns the private key of the new certificate and when it was generated.
+// With reuse_key, the key of the stored certificate is used until rotate_key_every has passed.
+// With tlsa, a new key is the next key published as TLSA record, tlsaPendingError is returned until its TTL has elapsed.
+func (a *AcmeService) certificateKey(siteLogger *logrus.Entry, cert *common.SiteCertificate, resource *store.Certificates) (crypto.PrivateKey, time.Time, error) {
+	if cert.Site.ReuseKey && resource != nil && len(resource.PrivateKey) != 0 && resource.CertKeyType() == cert.KeyType {
+		createdAt := keyCreatedAt(resource, nil)
+		rotation := cert.Site.KeyRotation()
+		if rotation == 0 || time.Now().Before(createdAt.Add(rotation)) {
+			privateKey, err := certcrypto.ParsePEMPrivateKey(resource.PrivateKey)
+			if err == nil {
+				siteLogger.WithField("key_created_at", createdAt.Format(time.RFC3339)).Debug("reuse private key")
+				return privateKey, createdAt, nil
+			}
+			siteLogger.WithError(err).Warn("error on parse stored private key, generate new one")
+		} else {
+			siteLogger.WithField("key_created_at", createdAt.Format(time.RFC3339)).Info("rotate private key")
+		}
+	}
+
+	if cert.Site.Tlsa != nil && resource != nil {
+		privateKey, err := nextKey(siteLogger, cert, resource)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		return privateKey, time.Now(), nil
+	}
+
+	privateKey, err := common.GeneratePrivateKey(cert.KeyType)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("error generate certificate private key %w", err)
+	}
+	return privateKey, time.Now(), nil
+}
+
+// keyRotationDue returns when the reused key of the certificate has to be rotated.
+// false is returned when the key is not reused or never rotated.
+func keyRotationDue(site *common.Site, resource *store.Certificates, leaf *x509.Certificate) (time.Time, bool) {
+	rotation := site.KeyRotation()
+	if !site.ReuseKey || rotation == 0 || resource == nil {
+		return time.Time{}, false
+	}
+	return keyCreatedAt(resource, leaf).Add(rotation), true
+}
+
+// keyCreatedAt returns when the key of the stored certificate was generated.
+// Resources written by earlier versions generated a key for each certificate, so the key is as old as the certificate.
+func keyCreatedAt(resource *store.Certificates, leaf *x509.Certificate) time.Time {
+	if resource.KeyCreatedAt != nil {
+		return *resource.KeyCreatedAt
+	}
+	if leaf == nil {
+		certs, err := resource.ExtractCertificate()
+		if err != nil || len(certs) == 0 {
+			return time.Time{}
+		}
+		leaf = certs[0]
+	}
+	return leaf.NotBefore
+}
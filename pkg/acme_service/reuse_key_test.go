@@ -0,0 +1,58 @@
+package acme_service
+
+import (
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestCertificateKey(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	service := &AcmeService{Config: &AcmeProcessConfig{RemainDays: 25}}
+	logger := logrus.NewEntry(logrus.New())
+	site := &common.Site{Name: "example", Domains: []string{"example.com"}, KeyType: common.KeyTypeEC256, ReuseKey: true}
+	cert := site.Certificates()[0]
+
+	storedKey, err := common.GeneratePrivateKey(common.KeyTypeEC256)
+	require.Nil(err)
+	createdAt := time.Now().Add(-60 * 24 * time.Hour).UTC().Truncate(time.Second)
+	resource := &store.Certificates{
+		KeyType:      common.KeyTypeEC256,
+		PrivateKey:   certcrypto.PEMEncode(storedKey),
+		KeyCreatedAt: &createdAt,
+	}
+
+	privateKey, keyCreatedAt, err := service.certificateKey(logger, cert, resource)
+	require.Nil(err)
+	assert.Equal(storedKey, privateKey)
+	assert.Equal(createdAt, keyCreatedAt)
+
+	// the key is rotated after rotate_key_every
+	site.RotateKeyEvery = "30d"
+	privateKey, keyCreatedAt, err = service.certificateKey(logger, cert, resource)
+	require.Nil(err)
+	assert.NotEqual(storedKey, privateKey)
+	assert.WithinDuration(time.Now(), keyCreatedAt, time.Minute)
+
+	leaf := generateLeaf(t, site.Domains, time.Now(), time.Now().Add(90*24*time.Hour))
+	rotation, ok := keyRotationDue(site, resource, leaf)
+	assert.True(ok)
+	assert.Equal(createdAt.Add(30*24*time.Hour), rotation)
+	assert.Equal(rotation, service.renewalDue(site, resource, leaf, nil))
+
+	// a new key is generated without reuse_key
+	site.ReuseKey = false
+	site.RotateKeyEvery = ""
+	privateKey, _, err = service.certificateKey(logger, cert, resource)
+	require.Nil(err)
+	assert.NotEqual(storedKey, privateKey)
+	_, ok = keyRotationDue(site, resource, leaf)
+	assert.False(ok)
+}
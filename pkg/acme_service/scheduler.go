@@ -0,0 +1,278 @@
+package acme_service
+
+import (
+	"container/heap"
+	"crypto/x509"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// minCheckDelay prevents a certificate which is due right after the check from being checked in a tight loop.
+const minCheckDelay = 1 * time.Minute
+
+type scheduleEntry struct {
+	cert  *common.SiteCertificate
+	due   time.Time
+	index int
+}
+
+// renewalQueue is a priority queue of certificates ordered by the time their next check is due.
+type renewalQueue struct {
+	entries []*scheduleEntry
+	names   map[string]*scheduleEntry
+}
+
+var _ heap.Interface = &renewalQueue{}
+
+func newRenewalQueue() *renewalQueue {
+	return &renewalQueue{
+		names: map[string]*scheduleEntry{},
+	}
+}
+
+func (q *renewalQueue) Len() int {
+	return len(q.entries)
+}
+
+func (q *renewalQueue) Less(i, j int) bool {
+	return q.entries[i].due.Before(q.entries[j].due)
+}
+
+func (q *renewalQueue) Swap(i, j int) {
+	q.entries[i], q.entries[j] = q.entries[j], q.entries[i]
+	q.entries[i].index = i
+	q.entries[j].index = j
+}
+
+func (q *renewalQueue) Push(x interface{}) {
+	entry := x.(*scheduleEntry)
+	entry.index = len(q.entries)
+	q.entries = append(q.entries, entry)
+	q.names[entry.cert.Name] = entry
+}
+
+func (q *renewalQueue) Pop() interface{} {
+	last := len(q.entries) - 1
+	entry := q.entries[last]
+	q.entries[last] = nil
+	q.entries = q.entries[:last]
+	delete(q.names, entry.cert.Name)
+	return entry
+}
+
+// schedule adds the certificate, or moves it if it is already in the queue.
+func (q *renewalQueue) schedule(cert *common.SiteCertificate, due time.Time) {
+	if entry, ok := q.names[cert.Name]; ok {
+		entry.cert = cert
+		entry.due = due
+		heap.Fix(q, entry.index)
+		return
+	}
+	heap.Push(q, &scheduleEntry{cert: cert, due: due})
+}
+
+// next returns the earliest due time.
+func (q *renewalQueue) next() (time.Time, bool) {
+	if len(q.entries) == 0 {
+		return time.Time{}, false
+	}
+	return q.entries[0].due, true
+}
+
+// peekDue returns the earliest certificate if it is due at now, without removing it.
+func (q *renewalQueue) peekDue(now time.Time) *common.SiteCertificate {
+	if len(q.entries) == 0 || q.entries[0].due.After(now) {
+		return nil
+	}
+	return q.entries[0].cert
+}
+
+// remove removes the certificate if it is in the queue.
+func (q *renewalQueue) remove(name string) {
+	if entry, ok := q.names[name]; ok {
+		heap.Remove(q, entry.index)
+	}
+}
+
+func (q *renewalQueue) clear() {
+	q.entries = nil
+	q.names = map[string]*scheduleEntry{}
+}
+
+// checkResult is a certificate checked by a worker.
+type checkResult struct {
+	cert    *common.SiteCertificate
+	due     time.Time
+	renewed bool
+}
+
+// scheduler feeds the certificates to a pool of workers when they are due,
+// so that a slow check, e.g. a dns-01 propagation, does not delay the other certificates.
+type scheduler struct {
+	workers      int
+	interval     time.Duration
+	logger       *logrus.Entry
+	certificates func() []*common.SiteCertificate
+	check        func(cert *common.SiteCertificate) (time.Time, bool)
+	// notify requests to publish the secrets, and must not block
+	notify func()
+	reload <-chan struct{}
+
+	queue *renewalQueue
+	// inFlight are the certificates being checked by workers
+	inFlight map[string]bool
+	// recheck are the certificates which were in flight at a full check, checked again when they are done
+	recheck map[string]bool
+	// dirty is set when the store may have changed since the last notification
+	dirty         bool
+	nextFullCheck time.Time
+}
+
+// StartLoop checks each certificate when it is due.
+// Every certificate is also checked each Config.Interval, which picks up certificates renewed by other instances
+// and suggested windows moved by the ca, and right after the sites config is reloaded.
+func (a *AcmeService) StartLoop() {
+	// the secrets are published on their own goroutine, so that a slow store or xds server never delays the schedule
+	notifyWakeup := make(chan struct{}, 1)
+	go func() {
+		for range notifyWakeup {
+			a.FireNotification()
+		}
+	}()
+	s := &scheduler{
+		workers:      a.Config.Workers,
+		interval:     a.Config.Interval,
+		logger:       a.logger,
+		certificates: func() []*common.SiteCertificate { return a.SitesConfig().Certificates() },
+		check:        a.renewCertificate,
+		notify: func() {
+			select {
+			case notifyWakeup <- struct{}{}:
+			default:
+			}
+		},
+		reload: a.reloadWakeup,
+	}
+	go s.run()
+}
+
+func (s *scheduler) run() {
+	workers := s.workers
+	if workers < 1 {
+		workers = 1
+	}
+	work := make(chan *common.SiteCertificate)
+	results := make(chan checkResult)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for cert := range work {
+				due, renewed := s.check(cert)
+				if min := time.Now().Add(minCheckDelay); due.Before(min) {
+					due = min
+				}
+				results <- checkResult{cert: cert, due: due, renewed: renewed}
+			}
+		}()
+	}
+
+	s.queue = newRenewalQueue()
+	s.inFlight = map[string]bool{}
+	s.recheck = map[string]bool{}
+	for {
+		now := time.Now()
+		if !now.Before(s.nextFullCheck) {
+			s.fullCheck(now)
+		}
+
+		// the due certificate is handed to a worker when one is free, otherwise it waits in the queue
+		var dispatch chan *common.SiteCertificate
+		head := s.queue.peekDue(now)
+		wakeup := s.nextFullCheck
+		if head != nil {
+			dispatch = work
+		} else if due, ok := s.queue.next(); ok && due.Before(wakeup) {
+			wakeup = due
+		}
+		if head == nil && len(s.inFlight) == 0 {
+			if s.dirty {
+				s.notify()
+				s.dirty = false
+			}
+			s.logger.WithField("next", wakeup.Format(time.RFC3339)).Debug("wait for next check")
+		}
+
+		// wait for a free worker, a checked certificate, the timer, or the sites config reloaded
+		t := time.NewTimer(time.Until(wakeup))
+		select {
+		case dispatch <- head:
+			s.queue.remove(head.Name)
+			s.inFlight[head.Name] = true
+		case result := <-results:
+			s.done(result)
+		case <-t.C:
+		case <-s.reload:
+			// handled right away, also while workers are checking certificates
+			s.logger.Info("sites config reloaded")
+			// drop the secrets of removed sites before the new sites are issued
+			s.notify()
+			s.fullCheck(time.Now())
+		}
+		t.Stop()
+	}
+}
+
+// fullCheck schedules all certificates of the sites config right now.
+// The certificates being checked are checked again when they are done, because their config may have changed.
+func (s *scheduler) fullCheck(now time.Time) {
+	s.logger.Debug("check all certificates")
+	s.queue.clear()
+	for _, cert := range s.certificates() {
+		if s.inFlight[cert.Name] {
+			s.recheck[cert.Name] = true
+			continue
+		}
+		s.queue.schedule(cert, now)
+	}
+	s.nextFullCheck = now.Add(s.interval)
+	s.dirty = true
+}
+
+// done schedules the next check of the certificate, unless its site was removed while it was checked.
+func (s *scheduler) done(result checkResult) {
+	name := result.cert.Name
+	delete(s.inFlight, name)
+	due := result.due
+	if s.recheck[name] {
+		delete(s.recheck, name)
+		due = time.Now()
+	}
+	for _, cert := range s.certificates() {
+		if cert.Name == name {
+			s.queue.schedule(cert, due)
+			break
+		}
+	}
+	if result.renewed {
+		// serve the new certificate right away, without waiting for the other checks
+		s.notify()
+	} else {
+		s.dirty = true
+	}
+}
+
+// renewalDue returns the time the certificate should be renewed,
+// by the renewal policy, the key rotation or the window suggested by the ca.
+func (a *AcmeService) renewalDue(site *common.Site, resource *store.Certificates, leaf *x509.Certificate, info *renewalInfo) time.Time {
+	due := a.expiryDue(site, leaf)
+	if rotation, ok := keyRotationDue(site, resource, leaf); ok && rotation.Before(due) {
+		due = rotation
+	}
+	if info != nil {
+		if suggested := info.RenewalTime(leaf); suggested.Before(due) {
+			due = suggested
+		}
+	}
+	return due
+}
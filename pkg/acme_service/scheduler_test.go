@@ -0,0 +1,204 @@
+package acme_service
+
+import (
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRenewalQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	site := &common.Site{Name: "a", Domains: []string{"a.example.com"}}
+	a := &common.SiteCertificate{Name: "a", Site: site}
+	b := &common.SiteCertificate{Name: "b", Site: site}
+	c := &common.SiteCertificate{Name: "c", Site: site}
+
+	queue := newRenewalQueue()
+	_, ok := queue.next()
+	assert.False(ok)
+
+	queue.schedule(a, now.Add(3*time.Hour))
+	queue.schedule(b, now.Add(time.Hour))
+	queue.schedule(c, now.Add(2*time.Hour))
+	next, ok := queue.next()
+	assert.True(ok)
+	assert.Equal(now.Add(time.Hour), next)
+
+	// reschedule moves the existing entry
+	queue.schedule(a, now.Add(-time.Minute))
+	assert.Equal(3, queue.Len())
+	assert.Equal(a, queue.peekDue(now))
+	queue.remove("a")
+	assert.Nil(queue.peekDue(now))
+	assert.Equal(b, queue.peekDue(now.Add(2*time.Hour)))
+	queue.remove("b")
+	queue.remove("b")
+	assert.Equal(c, queue.peekDue(now.Add(2*time.Hour)))
+	assert.Equal(1, queue.Len())
+}
+
+func TestSchedulerSlowCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	site := &common.Site{Name: "a", Domains: []string{"a.example.com"}}
+	certs := []*common.SiteCertificate{
+		{Name: "slow", Site: site},
+		{Name: "b", Site: site},
+		{Name: "c", Site: site},
+	}
+	release := make(chan struct{})
+	checked := make(chan string, 10)
+	notified := make(chan struct{}, 10)
+	s := &scheduler{
+		workers:      2,
+		interval:     time.Hour,
+		logger:       logrus.NewEntry(logrus.New()),
+		certificates: func() []*common.SiteCertificate { return certs },
+		check: func(cert *common.SiteCertificate) (time.Time, bool) {
+			if cert.Name == "slow" {
+				<-release
+			}
+			checked <- cert.Name
+			return time.Now().Add(time.Hour), cert.Name == "b"
+		},
+		notify: func() {
+			select {
+			case notified <- struct{}{}:
+			default:
+			}
+		},
+	}
+	go s.run()
+
+	// the other certificates are checked by the second worker while the slow one is running
+	var names []string
+	for i := 0; i < 2; i++ {
+		select {
+		case name := <-checked:
+			names = append(names, name)
+		case <-time.After(5 * time.Second):
+			t.Fatal("certificates are blocked by the slow check")
+		}
+	}
+	assert.ElementsMatch([]string{"b", "c"}, names)
+	// the renewed certificate is served without waiting for the slow check
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatal("renewed certificate is not notified")
+	}
+
+	close(release)
+	assert.Equal("slow", <-checked)
+}
+
+func TestRenewalDue(t *testing.T) {
+	assert := assert.New(t)
+
+	service := &AcmeService{Config: &AcmeProcessConfig{RemainDays: 25}}
+	site := &common.Site{Name: "example", Domains: []string{"example.com"}}
+	notAfter := time.Now().Add(90 * 24 * time.Hour).UTC().Truncate(time.Second)
+	leaf := generateLeaf(t, []string{"example.com"}, time.Now(), notAfter)
+
+	assert.Equal(notAfter.Add(-25*24*time.Hour), service.renewalDue(site, nil, leaf, nil))
+
+	info := &renewalInfo{}
+	info.SuggestedWindow.Start = time.Now().Add(24 * time.Hour)
+	info.SuggestedWindow.End = info.SuggestedWindow.Start.Add(time.Hour)
+	due := service.renewalDue(site, nil, leaf, info)
+	assert.False(due.Before(info.SuggestedWindow.Start))
+	assert.True(due.Before(info.SuggestedWindow.End))
+
+	// the window later than the remaining days does not delay the renewal
+	info.SuggestedWindow.Start = notAfter.Add(-time.Hour)
+	info.SuggestedWindow.End = notAfter
+	assert.Equal(notAfter.Add(-25*24*time.Hour), service.renewalDue(site, nil, leaf, info))
+}
+
+func TestExpiryDue(t *testing.T) {
+	assert := assert.New(t)
+
+	service := &AcmeService{Config: &AcmeProcessConfig{RemainDays: 25}}
+	site := &common.Site{Name: "example", Domains: []string{"example.com"}}
+	notBefore := time.Now().UTC().Truncate(time.Second)
+	shortLived := generateLeaf(t, site.Domains, notBefore, notBefore.Add(6*24*time.Hour))
+
+	// --cert-days is limited to a third of the lifetime
+	assert.Equal(notBefore.Add(4*24*time.Hour), service.expiryDue(site, shortLived))
+	assert.False(service.needRenewal(site, shortLived))
+
+	site.RenewBefore = "50%"
+	assert.Equal(notBefore.Add(3*24*time.Hour), service.expiryDue(site, shortLived))
+
+	site.RenewBefore = "12h"
+	assert.Equal(notBefore.Add(5*24*time.Hour+12*time.Hour), service.expiryDue(site, shortLived))
+
+	site.RenewBefore = "7d"
+	assert.True(service.needRenewal(site, shortLived))
+
+	// the short-lived profile is renewed at the half of the lifetime by default
+	site.RenewBefore = ""
+	site.Profile = common.ProfileShortLived
+	assert.Equal(notBefore.Add(3*24*time.Hour), service.expiryDue(site, shortLived))
+}
+
+func TestSchedulerReload(t *testing.T) {
+	assert := assert.New(t)
+
+	site := &common.Site{Name: "a", Domains: []string{"a.example.com"}}
+	certsMutex := sync.Mutex{}
+	certs := []*common.SiteCertificate{{Name: "slow", Site: site}}
+	release := make(chan struct{})
+	checked := make(chan string, 10)
+	notified := make(chan struct{}, 1)
+	reload := make(chan struct{}, 1)
+	s := &scheduler{
+		workers:  2,
+		interval: time.Hour,
+		logger:   logrus.NewEntry(logrus.New()),
+		certificates: func() []*common.SiteCertificate {
+			certsMutex.Lock()
+			defer certsMutex.Unlock()
+			return certs
+		},
+		check: func(cert *common.SiteCertificate) (time.Time, bool) {
+			checked <- cert.Name
+			if cert.Name == "slow" {
+				<-release
+			}
+			return time.Now().Add(time.Hour), false
+		},
+		notify: func() {
+			select {
+			case notified <- struct{}{}:
+			default:
+			}
+		},
+		reload: reload,
+	}
+	go s.run()
+	assert.Equal("slow", <-checked)
+
+	// the reload is handled while the slow check is running
+	certsMutex.Lock()
+	certs = []*common.SiteCertificate{{Name: "new", Site: site}}
+	certsMutex.Unlock()
+	reload <- struct{}{}
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatal("secrets are not published on reload")
+	}
+	select {
+	case name := <-checked:
+		assert.Equal("new", name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("new certificate is blocked by the slow check")
+	}
+	close(release)
+}
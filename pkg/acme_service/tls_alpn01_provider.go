@@ -0,0 +1,97 @@
+package acme_service
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store"
+	"time"
+)
+
+var _ challenge.Provider = &tlsAlpn01Provider{}
+
+// tlsAlpn01ServeTimeout is how long Present waits for Envoy to acknowledge the challenge certificate
+const tlsAlpn01ServeTimeout = 30 * time.Second
+
+// tlsAlpn01LockInterval is the interval to retry the lock of a domain which is validated by another order
+const tlsAlpn01LockInterval = time.Second
+
+// tlsAlpn01Provider writes tls-alpn-01 challenges to the store and pushes them to Envoy
+// as temporary SDS secrets, so envoy-acme never has to bind :443 itself.
+// The secret is named after the domain, so the challenges of a domain are validated one at a time,
+// e.g. the orders of dual_key_type, while the lock of the domain is held from Present to CleanUp.
+type tlsAlpn01Provider struct {
+	service *AcmeService
+	// wait is how long Present waits after the local Envoy has served the certificate before the ca is asked to validate,
+	// so that the Envoys of the other instances, which poll the challenges, also serve the certificate.
+	wait time.Duration
+}
+
+func newTlsAlpn01Provider(service *AcmeService) *tlsAlpn01Provider {
+	return &tlsAlpn01Provider{
+		service: service,
+		wait:    service.Config.ChallengeWatchInterval,
+	}
+}
+
+// lockName returns the name of the store lock of the challenge secret of the domain.
+func (p *tlsAlpn01Provider) lockName(domain string) string {
+	return string(challenge.TLSALPN01) + "-" + domain
+}
+
+// lockId returns the id the challenge holds the lock with, which differs between the orders of an instance.
+func (p *tlsAlpn01Provider) lockId(token string) string {
+	return p.service.Config.InstanceId + "/" + token
+}
+
+func (p *tlsAlpn01Provider) Present(domain, token, keyAuth string) error {
+	logger := p.service.logger.WithField("domain", domain)
+	deadline := time.Now().Add(p.service.Config.LockTimeout)
+	for {
+		ok, err := p.service.Store.Lock(p.lockName(domain), p.lockId(token), p.service.Config.LockTimeout)
+		if err != nil {
+			return fmt.Errorf("error lock tls-alpn-01 challenge %w", err)
+		}
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tls-alpn-01 challenge of %s is validated by another order", domain)
+		}
+		logger.Debug("wait for the tls-alpn-01 challenge of another order")
+		time.Sleep(tlsAlpn01LockInterval)
+	}
+
+	err := p.service.Store.WriteChallenge(&store.Challenge{
+		Type:    string(challenge.TLSALPN01),
+		Domain:  domain,
+		Token:   token,
+		KeyAuth: keyAuth,
+	})
+	if err != nil {
+		p.service.Store.Release(p.lockName(domain), p.lockId(token))
+		return err
+	}
+	// the snapshot is handed to the local xds server when FireNotification returns
+	p.service.FireNotification()
+	if p.service.ChallengeServed != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), tlsAlpn01ServeTimeout)
+		err = p.service.ChallengeServed(ctx, domain)
+		cancel()
+		if err != nil {
+			logger.WithError(err).Warn("the challenge certificate is not acknowledged by envoy")
+		}
+	}
+	logger.WithField("wait", p.wait.String()).Debug("wait for the challenge certificate to be served by the other instances")
+	time.Sleep(p.wait)
+	return nil
+}
+
+func (p *tlsAlpn01Provider) CleanUp(domain, token, keyAuth string) error {
+	err := p.service.Store.DeleteChallenge(string(challenge.TLSALPN01), token)
+	if err != nil {
+		return err
+	}
+	p.service.FireNotification()
+	return p.service.Store.Release(p.lockName(domain), p.lockId(token))
+}
@@ -0,0 +1,71 @@
+package acme_service
+
+import (
+	"context"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store/file_store"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTlsAlpn01ProviderPresent(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "acme-tls-alpn01")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	fileStore, err := file_store.NewFileStore(dir)
+	require.Nil(err)
+
+	service := NewAcmeService(&AcmeProcessConfig{
+		ChallengeWatchInterval: 200 * time.Millisecond,
+		InstanceId:             "instance",
+		LockTimeout:            time.Minute,
+	}, &common.SitesConfig{}, fileStore, logrus.New())
+	served := make(chan time.Time, 2)
+	service.ChallengeServed = func(ctx context.Context, domain string) error {
+		served <- time.Now()
+		return nil
+	}
+	provider := newTlsAlpn01Provider(service)
+	assert.Equal(200*time.Millisecond, provider.wait)
+
+	notified := make(chan time.Time, 4)
+	challenges := make(chan int, 4)
+	go func() {
+		for notification := range service.NotificationChannel() {
+			challenges <- len(notification.Challenges)
+			notified <- time.Now()
+		}
+	}()
+	start := time.Now()
+	require.Nil(provider.Present("www.example.com", "token", "keyauth"))
+	// the ca is not asked to validate until envoy and the other instances have had the time to serve the certificate
+	assert.True(time.Since(start) >= provider.wait)
+	assert.True((<-notified).Sub(start) < provider.wait)
+	assert.Equal(1, <-challenges)
+	assert.True((<-served).Sub(start) < provider.wait)
+
+	// the challenge of the other order of the domain waits for the clean up, because the secret has the same name
+	presented := make(chan error)
+	go func() {
+		presented <- provider.Present("www.example.com", "token-rsa", "keyauth-rsa")
+	}()
+	select {
+	case <-presented:
+		assert.Fail("presented while the domain is validated")
+	case <-time.After(500 * time.Millisecond):
+	}
+	require.Nil(provider.CleanUp("www.example.com", "token", "keyauth"))
+	require.Nil(<-presented)
+	// the secret is never published with the challenges of both orders
+	assert.Equal(0, <-challenges)
+	assert.Equal(1, <-challenges)
+	require.Nil(provider.CleanUp("www.example.com", "token-rsa", "keyauth-rsa"))
+}
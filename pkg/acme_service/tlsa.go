@@ -0,0 +1,309 @@
+package acme_service
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/dns_provider"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+var tlsaUpdatedCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: common.PrometheusNamespace,
+	Name:      "tlsa_updated",
+})
+
+// tlsaPendingError is returned when the certificate has to be issued with the next key,
+// but the TLSA record of the key has not been published for the TTL yet.
+type tlsaPendingError struct {
+	until time.Time
+}
+
+func (t *tlsaPendingError) Error() string {
+	return fmt.Sprintf("next key is published until %s", t.until.Format(time.RFC3339))
+}
+
+// nextKey returns the pre-published next key of the certificate, once its TLSA record is cached by every resolver.
+func nextKey(siteLogger *logrus.Entry, cert *common.SiteCertificate, resource *store.Certificates) (crypto.PrivateKey, error) {
+	ttl := cert.Site.Tlsa.RecordTTL()
+	until := time.Now().Add(ttl)
+	if resource.NextKeyPublishedAt != nil {
+		until = resource.NextKeyPublishedAt.Add(ttl)
+	}
+
+	var privateKey crypto.PrivateKey
+	if len(resource.NextPrivateKey) != 0 {
+		key, err := certcrypto.ParsePEMPrivateKey(resource.NextPrivateKey)
+		if err == nil && common.KeyTypeOf(key) == cert.KeyType {
+			privateKey = key
+		}
+	}
+	if privateKey != nil && resource.NextKeyPublishedAt != nil && !time.Now().Before(until) {
+		return privateKey, nil
+	}
+
+	// an expired certificate is worse than the mismatch of the TLSA records
+	certs, err := resource.ExtractCertificate()
+	if err == nil && len(certs) != 0 && certs[0].NotAfter.Before(until.Add(24*time.Hour)) {
+		siteLogger.WithField("not_after", certs[0].NotAfter.Format(time.RFC3339)).Warn("issue with a key not published as tlsa record, because the certificate expires soon")
+		if privateKey != nil {
+			return privateKey, nil
+		}
+		return common.GeneratePrivateKey(cert.KeyType)
+	}
+	return nil, &tlsaPendingError{until: until}
+}
+
+// reconcileTlsa publishes the TLSA records of the current and the next key of every certificate of the site,
+// and removes the records of keys no longer used after the ttl. The next key is generated when the certificate has none.
+func (a *AcmeService) reconcileTlsa(siteLogger *logrus.Entry, cert *common.SiteCertificate) error {
+	site := cert.Site
+	resource, err := a.Store.FetchResource(cert.Name)
+	if errors.Is(err, store.ErrNotFoundCertificate) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("fetch resource error %w", err)
+	}
+	if site.Tlsa == nil && len(resource.TlsaRecords) == 0 {
+		return nil
+	}
+
+	changed := false
+	if site.Tlsa != nil {
+		var key crypto.PrivateKey
+		if len(resource.NextPrivateKey) != 0 {
+			key, err = certcrypto.ParsePEMPrivateKey(resource.NextPrivateKey)
+		}
+		if len(resource.NextPrivateKey) == 0 || err != nil || common.KeyTypeOf(key) != cert.KeyType {
+			siteLogger.WithField("key_type", cert.KeyType).Info("generate next private key")
+			key, err = common.GeneratePrivateKey(cert.KeyType)
+			if err != nil {
+				return fmt.Errorf("error generate next private key %w", err)
+			}
+			resource.NextPrivateKey = certcrypto.PEMEncode(key)
+			resource.NextKeyPublishedAt = nil
+			changed = true
+		}
+	}
+
+	records, err := a.tlsaRecords(cert, resource)
+	if err != nil {
+		return err
+	}
+	var ttl time.Duration
+	if site.Tlsa != nil {
+		ttl = site.Tlsa.RecordTTL()
+	}
+	records, retired := retireTlsaRecords(resource, records, time.Now(), ttl)
+	if !sameRecords(records, resource.TlsaRecords) {
+		writer, err := siteRecordWriter(site)
+		if err != nil {
+			return err
+		}
+		err = writeTlsaRecords(writer, resource.TlsaRecords, records, ttl)
+		if err != nil {
+			return fmt.Errorf("error on write tlsa records %w", err)
+		}
+		siteLogger.WithField("records", records).Info("tlsa records published")
+		tlsaUpdatedCounter.Inc()
+		resource.TlsaRecords = records
+		changed = true
+	}
+	if !sameRetired(retired, resource.TlsaRetired) {
+		resource.TlsaRetired = retired
+		changed = true
+	}
+	if site.Tlsa != nil && resource.NextKeyPublishedAt == nil {
+		now := time.Now()
+		resource.NextKeyPublishedAt = &now
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+	return a.Store.WriteResource(cert.Name, resource)
+}
+
+// tlsaRecords returns the TLSA records of the site as "owner digest".
+// The records of the other certificates of the site are included, because they share the owner names.
+func (a *AcmeService) tlsaRecords(cert *common.SiteCertificate, resource *store.Certificates) ([]string, error) {
+	site := cert.Site
+	if site.Tlsa == nil {
+		return nil, nil
+	}
+
+	var keys [][]byte
+	for _, siteCert := range site.Certificates() {
+		siteResource := resource
+		if siteCert.Name != cert.Name {
+			var err error
+			siteResource, err = a.Store.FetchResource(siteCert.Name)
+			if errors.Is(err, store.ErrNotFoundCertificate) {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("fetch resource error %w", err)
+			}
+		}
+		keys = append(keys, siteResource.PrivateKey, siteResource.NextPrivateKey)
+	}
+
+	digests := map[string]bool{}
+	for _, keyPEM := range keys {
+		if len(keyPEM) == 0 {
+			continue
+		}
+		privateKey, err := certcrypto.ParsePEMPrivateKey(keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("error parse private key %w", err)
+		}
+		digest, err := tlsaDigest(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		digests[digest] = true
+	}
+
+	var records []string
+	for _, owner := range tlsaOwners(site) {
+		for digest := range digests {
+			records = append(records, owner+" "+digest)
+		}
+	}
+	sort.Strings(records)
+	return records, nil
+}
+
+// retireTlsaRecords returns the records to publish, which keep the published records no longer in records for the ttl,
+// so that resolvers which cached the record set before the switch still find the key of the certificate served
+// until then, e.g. by an instance which has not loaded the new certificate yet. The retired records are returned
+// with the time they are removed, at the first check after it.
+func retireTlsaRecords(resource *store.Certificates, records []string, now time.Time, ttl time.Duration) ([]string, map[string]time.Time) {
+	current := map[string]bool{}
+	for _, record := range records {
+		current[record] = true
+	}
+	retired := map[string]time.Time{}
+	for _, record := range resource.TlsaRecords {
+		if current[record] {
+			continue
+		}
+		until, ok := resource.TlsaRetired[record]
+		if !ok {
+			until = now.Add(ttl)
+		}
+		if now.Before(until) {
+			retired[record] = until
+		}
+	}
+
+	published := append([]string{}, records...)
+	for record := range retired {
+		published = append(published, record)
+	}
+	sort.Strings(published)
+	if len(retired) == 0 {
+		retired = nil
+	}
+	return published, retired
+}
+
+// tlsaOwners returns the owner names of the TLSA records, e.g. "_443._tcp.www.example.com.".
+func tlsaOwners(site *common.Site) []string {
+	var owners []string
+	for _, domain := range site.Domains {
+		for _, port := range site.Tlsa.TlsaPorts() {
+			owners = append(owners, dns.Fqdn(fmt.Sprintf("_%d._tcp.%s", port, strings.ToLower(domain))))
+		}
+	}
+	return owners
+}
+
+// tlsaDigest returns the SHA-256 digest of the public key, the data of the "3 1 1" TLSA record.
+func tlsaDigest(privateKey crypto.PrivateKey) (string, error) {
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return "", fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+	spki, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(spki)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// writeTlsaRecords replaces the records of the owners in records, and deletes the owners only in published.
+func writeTlsaRecords(writer dns_provider.RecordWriter, published, records []string, ttl time.Duration) error {
+	rrsets := map[string][]dns.RR{}
+	var owners []string
+	for _, record := range records {
+		parts := strings.SplitN(record, " ", 2)
+		if _, ok := rrsets[parts[0]]; !ok {
+			owners = append(owners, parts[0])
+		}
+		rrsets[parts[0]] = append(rrsets[parts[0]], &dns.TLSA{
+			Hdr: dns.RR_Header{
+				Name:   parts[0],
+				Rrtype: dns.TypeTLSA,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(ttl / time.Second),
+			},
+			Usage:        3,
+			Selector:     1,
+			MatchingType: 1,
+			Certificate:  parts[1],
+		})
+	}
+	for _, record := range published {
+		owner := strings.SplitN(record, " ", 2)[0]
+		if _, ok := rrsets[owner]; !ok {
+			rrsets[owner] = nil
+			owners = append(owners, owner)
+		}
+	}
+
+	for _, owner := range owners {
+		err := writer.ReplaceRecords(owner, dns.TypeTLSA, rrsets[owner])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sameRetired(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for record, until := range a {
+		if other, ok := b[record]; !ok || !other.Equal(until) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameRecords(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
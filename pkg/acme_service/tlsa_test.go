@@ -0,0 +1,149 @@
+package acme_service
+
+import (
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+type fakeRecordWriter struct {
+	rrsets map[string][]dns.RR
+}
+
+func (f *fakeRecordWriter) ReplaceRecords(fqdn string, rrtype uint16, rrs []dns.RR) error {
+	if len(rrs) == 0 {
+		delete(f.rrsets, fqdn)
+		return nil
+	}
+	f.rrsets[fqdn] = rrs
+	return nil
+}
+
+func TestTlsaRecords(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	service := &AcmeService{Config: &AcmeProcessConfig{}}
+	site := &common.Site{
+		Name:     "example",
+		Domains:  []string{"example.com", "WWW.example.com"},
+		KeyType:  common.KeyTypeEC256,
+		Provider: "rfc2136",
+		Tlsa:     &common.Tlsa{TTL: 300},
+	}
+	cert := site.Certificates()[0]
+	current, err := common.GeneratePrivateKey(common.KeyTypeEC256)
+	require.Nil(err)
+	next, err := common.GeneratePrivateKey(common.KeyTypeEC256)
+	require.Nil(err)
+	resource := &store.Certificates{
+		PrivateKey:     certcrypto.PEMEncode(current),
+		NextPrivateKey: certcrypto.PEMEncode(next),
+	}
+	currentDigest, err := tlsaDigest(current)
+	require.Nil(err)
+	nextDigest, err := tlsaDigest(next)
+	require.Nil(err)
+	assert.Len(currentDigest, 64)
+
+	records, err := service.tlsaRecords(cert, resource)
+	require.Nil(err)
+	assert.Len(records, 4)
+	assert.Contains(records, "_443._tcp.example.com. "+currentDigest)
+	assert.Contains(records, "_443._tcp.www.example.com. "+nextDigest)
+
+	writer := &fakeRecordWriter{rrsets: map[string][]dns.RR{}}
+	require.Nil(writeTlsaRecords(writer, nil, records, 300*time.Second))
+	require.Len(writer.rrsets["_443._tcp.example.com."], 2)
+	tlsa := writer.rrsets["_443._tcp.example.com."][0].(*dns.TLSA)
+	assert.Equal(uint32(300), tlsa.Hdr.Ttl)
+	assert.Equal(uint8(3), tlsa.Usage)
+	assert.Equal(uint8(1), tlsa.Selector)
+	assert.Equal(uint8(1), tlsa.MatchingType)
+
+	// the owners of removed domains are deleted
+	site.Domains = []string{"example.com"}
+	newRecords, err := service.tlsaRecords(cert, resource)
+	require.Nil(err)
+	require.Nil(writeTlsaRecords(writer, records, newRecords, 300*time.Second))
+	assert.Len(writer.rrsets, 1)
+	assert.Contains(writer.rrsets, "_443._tcp.example.com.")
+}
+
+func TestRetireTlsaRecords(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	resource := &store.Certificates{
+		TlsaRecords: []string{"_443._tcp.example.com. current", "_443._tcp.example.com. old"},
+	}
+
+	// the record of the old key is kept for the ttl after the switch
+	records, retired := retireTlsaRecords(resource, []string{"_443._tcp.example.com. current", "_443._tcp.example.com. next"}, now, time.Hour)
+	assert.Equal([]string{"_443._tcp.example.com. current", "_443._tcp.example.com. next", "_443._tcp.example.com. old"}, records)
+	assert.Equal(map[string]time.Time{"_443._tcp.example.com. old": now.Add(time.Hour)}, retired)
+
+	// the time of the removal is not extended by later checks
+	resource.TlsaRecords = records
+	resource.TlsaRetired = retired
+	records, retired = retireTlsaRecords(resource, []string{"_443._tcp.example.com. current", "_443._tcp.example.com. next"}, now.Add(30*time.Minute), time.Hour)
+	assert.Len(records, 3)
+	assert.Equal(now.Add(time.Hour), retired["_443._tcp.example.com. old"])
+
+	// removed after the ttl
+	records, retired = retireTlsaRecords(resource, []string{"_443._tcp.example.com. current", "_443._tcp.example.com. next"}, now.Add(time.Hour), time.Hour)
+	assert.Equal([]string{"_443._tcp.example.com. current", "_443._tcp.example.com. next"}, records)
+	assert.Nil(retired)
+
+	// removed right away without tlsa
+	records, retired = retireTlsaRecords(&store.Certificates{TlsaRecords: records}, nil, now, 0)
+	assert.Empty(records)
+	assert.Nil(retired)
+}
+
+func TestNextKey(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	logger := logrus.NewEntry(logrus.New())
+	site := &common.Site{Name: "example", Domains: []string{"example.com"}, KeyType: common.KeyTypeEC256, Tlsa: &common.Tlsa{TTL: 3600}}
+	cert := site.Certificates()[0]
+	next, err := common.GeneratePrivateKey(common.KeyTypeEC256)
+	require.Nil(err)
+	leaf := generateLeaf(t, site.Domains, time.Now().Add(-60*24*time.Hour), time.Now().Add(30*24*time.Hour))
+	publishedAt := time.Now().Add(-10 * time.Minute)
+	resource := &store.Certificates{
+		Certificate:        encodeChain(leaf),
+		NextPrivateKey:     certcrypto.PEMEncode(next),
+		NextKeyPublishedAt: &publishedAt,
+	}
+
+	// the record is not cached long enough
+	_, err = nextKey(logger, cert, resource)
+	pending, ok := err.(*tlsaPendingError)
+	require.True(ok)
+	assert.Equal(publishedAt.Add(time.Hour), pending.until)
+
+	publishedAt = time.Now().Add(-2 * time.Hour)
+	privateKey, err := nextKey(logger, cert, resource)
+	require.Nil(err)
+	assert.Equal(next, privateKey)
+
+	// the next key of another key type is not used
+	site.KeyType = common.KeyTypeEC384
+	_, err = nextKey(logger, site.Certificates()[0], resource)
+	assert.IsType(&tlsaPendingError{}, err)
+
+	// the certificate expiring soon is renewed anyway
+	expiring := generateLeaf(t, site.Domains, time.Now().Add(-89*24*time.Hour), time.Now().Add(12*time.Hour))
+	resource.Certificate = encodeChain(expiring)
+	privateKey, err = nextKey(logger, site.Certificates()[0], resource)
+	require.Nil(err)
+	assert.Equal(common.KeyTypeEC384, common.KeyTypeOf(privateKey))
+}
@@ -1,21 +1,301 @@
 package common
 
-import "github.com/kamijin-fanta/envoy-acme/pkg/store"
+import (
+	"errors"
+	"fmt"
+	"github.com/ghodss/yaml"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/kamijin-fanta/envoy-acme/pkg/dns_provider"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store"
+	"net/url"
+	"strings"
+	"time"
+)
 
 type Notification struct {
-	Certificates []*store.Certificates
+	// Certificates is keyed by the SDS secret name
+	Certificates map[string]*store.Certificates
+	Challenges   []*store.Challenge
 }
 
 type SitesConfig struct {
-	Sites []*Site `yaml:"sites"`
+	Sites                  []*Site                 `yaml:"sites"`
+	CertificateAuthorities []*CertificateAuthority `yaml:"cas" json:"cas"`
+}
+
+// ParseSitesConfig parses and validates the sites config.
+func ParseSitesConfig(configBytes []byte) (*SitesConfig, error) {
+	sitesConfig := &SitesConfig{}
+	err := yaml.Unmarshal(configBytes, sitesConfig)
+	if err != nil {
+		return nil, err
+	}
+	err = sitesConfig.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return sitesConfig, nil
+}
+
+// Certificates returns the certificates of all sites.
+func (s *SitesConfig) Certificates() []*SiteCertificate {
+	var certs []*SiteCertificate
+	for _, site := range s.Sites {
+		certs = append(certs, site.Certificates()...)
+	}
+	return certs
+}
+
+// ExternalAccountBinding returns the EAB credentials used to register accounts of the site at the ACME directory.
+// The settings of the site take precedence over the settings of the CA. nil is returned when EAB is not used.
+func (s *SitesConfig) ExternalAccountBinding(site *Site, caDir string) *ExternalAccountBinding {
+	if site.ExternalAccountBinding.Enabled() {
+		return &site.ExternalAccountBinding
+	}
+	for _, ca := range s.CertificateAuthorities {
+		if ca.Directory == caDir && ca.ExternalAccountBinding.Enabled() {
+			return &ca.ExternalAccountBinding
+		}
+	}
+	return nil
+}
+
+func (s *SitesConfig) Validate() error {
+	for i, ca := range s.CertificateAuthorities {
+		if ca == nil || ca.Directory == "" {
+			return fmt.Errorf("cas[%d]: directory is required", i)
+		}
+		err := ca.ExternalAccountBinding.Validate()
+		if err != nil {
+			return fmt.Errorf("ca '%s': %w", ca.Directory, err)
+		}
+	}
+	names := map[string]bool{}
+	for i, site := range s.Sites {
+		if site == nil {
+			return fmt.Errorf("sites[%d]: empty site", i)
+		}
+		if site.Name == "" {
+			return fmt.Errorf("sites[%d]: name is required", i)
+		}
+		err := site.Validate()
+		if err != nil {
+			return fmt.Errorf("site '%s': %w", site.Name, err)
+		}
+		for _, cert := range site.Certificates() {
+			if names[cert.Name] {
+				return fmt.Errorf("site '%s': duplicate name '%s'", site.Name, cert.Name)
+			}
+			names[cert.Name] = true
+		}
+	}
+	return nil
 }
 
 type Site struct {
-	Name     string   `yaml:"name"`
-	Provider string   `yaml:"provider"`
-	Email    string   `yaml:"email"`
-	Domains  []string `yaml:"domains"`
-	LegoEnv  []string `yaml:"legoenv"`
+	Name           string       `yaml:"name"`
+	Challenge      string       `yaml:"challenge"`
+	Provider       string       `yaml:"provider"`
+	Email          string       `yaml:"email"`
+	Domains        []string     `yaml:"domains"`
+	LegoEnv        []string     `yaml:"legoenv"`
+	KeyType        string       `yaml:"key_type" json:"key_type"`
+	DualKeyType    string       `yaml:"dual_key_type" json:"dual_key_type"`
+	CaDir          string       `yaml:"ca_dir" json:"ca_dir"`
+	RenewBefore    string       `yaml:"renew_before" json:"renew_before"`
+	Profile        string       `yaml:"profile" json:"profile"`
+	PreferredChain string       `yaml:"preferred_chain" json:"preferred_chain"`
+	ReuseKey       bool         `yaml:"reuse_key" json:"reuse_key"`
+	RotateKeyEvery string       `yaml:"rotate_key_every" json:"rotate_key_every"`
+	Tlsa           *Tlsa        `yaml:"tlsa" json:"tlsa"`
+	Propagation    *Propagation `yaml:"propagation" json:"propagation"`
+	// DomainProviders write the challenges of the listed domains, instead of Provider
+	DomainProviders []*DomainProvider `yaml:"domain_providers" json:"domain_providers"`
+	// ChallengeAlias writes the challenges at _acme-challenge.<alias>, which _acme-challenge.<domain> is a CNAME of,
+	// so that the provider needs the credentials of the alias zone only
+	ChallengeAlias string `yaml:"challenge_alias" json:"challenge_alias"`
+	ExternalAccountBinding
+}
+
+// SiteCertificate is a certificate issued for a site.
+// A site has two of them when DualKeyType is set, which are stored and renewed independently.
+type SiteCertificate struct {
+	Name    string
+	KeyType string
+	Site    *Site
+}
+
+func (s *Site) Validate() error {
+	if len(s.Domains) == 0 {
+		return errors.New("domains is required")
+	}
+	seen := map[string]bool{}
+	for _, domain := range s.Domains {
+		if seen[strings.ToLower(domain)] {
+			return fmt.Errorf("duplicate domain '%s'", domain)
+		}
+		seen[strings.ToLower(domain)] = true
+	}
+	switch s.ChallengeType() {
+	case challenge.DNS01:
+		err := s.validateDomainProviders()
+		if err != nil {
+			return err
+		}
+		if site := s.siteDNSProvider(); len(site.Domains) != 0 {
+			err := site.Validate()
+			if err != nil {
+				return err
+			}
+		}
+	case challenge.HTTP01, challenge.TLSALPN01:
+		if len(s.DomainProviders) != 0 || s.ChallengeAlias != "" {
+			return errors.New("domain_providers and challenge_alias require dns-01 challenge")
+		}
+		for _, domain := range s.Domains {
+			if strings.HasPrefix(domain, "*.") {
+				return fmt.Errorf("wildcard domain '%s' requires dns-01 challenge", domain)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported challenge type '%s'", s.Challenge)
+	}
+	if s.CaDir != "" {
+		caUrl, err := url.Parse(s.CaDir)
+		if err != nil {
+			return fmt.Errorf("invalid ca_dir %w", err)
+		}
+		if caUrl.Scheme != "https" && caUrl.Scheme != "http" {
+			return fmt.Errorf("ca_dir '%s' must be a http or https url", s.CaDir)
+		}
+	}
+	if strings.TrimSpace(s.Profile) != s.Profile {
+		return fmt.Errorf("invalid profile '%s'", s.Profile)
+	}
+	if s.RenewBefore != "" {
+		_, err := ParseRenewBefore(s.RenewBefore)
+		if err != nil {
+			return fmt.Errorf("renew_before: %w", err)
+		}
+	}
+	if s.RotateKeyEvery != "" {
+		if !s.ReuseKey {
+			return errors.New("rotate_key_every requires reuse_key")
+		}
+		_, err := ParseDuration(s.RotateKeyEvery)
+		if err != nil {
+			return fmt.Errorf("rotate_key_every: %w", err)
+		}
+	}
+	if s.Tlsa != nil {
+		for _, dp := range s.DNSProviders() {
+			if !dns_provider.SupportsRecords(dp.Provider) {
+				return fmt.Errorf("tlsa requires a provider which can write records, must be one of %s", strings.Join(dns_provider.RecordProviders(), ", "))
+			}
+			_, err := dns_provider.ParseEnv(dp.LegoEnv)
+			if err != nil {
+				return fmt.Errorf("legoenv: %w", err)
+			}
+		}
+		err := s.Tlsa.Validate()
+		if err != nil {
+			return fmt.Errorf("tlsa: %w", err)
+		}
+	}
+	if s.Propagation != nil {
+		if s.ChallengeType() != challenge.DNS01 {
+			return errors.New("propagation requires dns-01 challenge")
+		}
+		err := s.Propagation.Validate()
+		if err != nil {
+			return fmt.Errorf("propagation: %w", err)
+		}
+	}
+	err := s.ExternalAccountBinding.Validate()
+	if err != nil {
+		return err
+	}
+	if !ValidKeyType(s.CertKeyType()) {
+		return fmt.Errorf("unknown key_type '%s', must be one of %s", s.KeyType, strings.Join(KeyTypes, ", "))
+	}
+	if s.DualKeyType != "" {
+		if !ValidKeyType(s.DualKeyType) {
+			return fmt.Errorf("unknown dual_key_type '%s', must be one of %s", s.DualKeyType, strings.Join(KeyTypes, ", "))
+		}
+		if KeyAlgorithm(s.DualKeyType) == KeyAlgorithm(s.CertKeyType()) {
+			return fmt.Errorf("dual_key_type '%s' must use another algorithm than key_type '%s'", s.DualKeyType, s.CertKeyType())
+		}
+	}
+	return nil
 }
 
+// Certificates returns the certificates issued for the site.
+// The certificate of DualKeyType is named with the algorithm suffix, e.g. "name-rsa".
+func (s *Site) Certificates() []*SiteCertificate {
+	certs := []*SiteCertificate{
+		{
+			Name:    s.Name,
+			KeyType: s.CertKeyType(),
+			Site:    s,
+		},
+	}
+	if s.DualKeyType != "" {
+		certs = append(certs, &SiteCertificate{
+			Name:    fmt.Sprintf("%s-%s", s.Name, KeyAlgorithm(s.DualKeyType)),
+			KeyType: s.DualKeyType,
+			Site:    s,
+		})
+	}
+	return certs
+}
+
+// ChallengeType returns the ACME challenge used for the site. dns-01 is used when not specified.
+func (s *Site) ChallengeType() challenge.Type {
+	if s.Challenge == "" {
+		return challenge.DNS01
+	}
+	return challenge.Type(s.Challenge)
+}
+
+// CertKeyType returns the private key type of the certificate. DefaultKeyType is used when not specified.
+func (s *Site) CertKeyType() string {
+	if s.KeyType == "" {
+		return DefaultKeyType
+	}
+	return s.KeyType
+}
+
+// RenewalPolicy returns the renew_before setting of the site, or nil when the global --cert-days is used.
+// Certificates of the short-lived profile are renewed at the half of their lifetime by default.
+func (s *Site) RenewalPolicy() *RenewBefore {
+	if s.RenewBefore == "" {
+		if s.Profile == ProfileShortLived {
+			return &RenewBefore{Fraction: 0.5}
+		}
+		return nil
+	}
+	policy, err := ParseRenewBefore(s.RenewBefore)
+	if err != nil {
+		// rejected by Validate
+		return nil
+	}
+	return policy
+}
+
+// KeyRotation returns how long the private key is reused, or 0 when it is reused forever.
+func (s *Site) KeyRotation() time.Duration {
+	if s.RotateKeyEvery == "" {
+		return 0
+	}
+	duration, err := ParseDuration(s.RotateKeyEvery)
+	if err != nil {
+		// rejected by Validate
+		return 0
+	}
+	return duration
+}
+
+// ProfileShortLived is the ACME profile of Let's Encrypt for certificates valid for several days.
+const ProfileShortLived = "shortlived"
+
 const PrometheusNamespace = "envoy_acme_sds"
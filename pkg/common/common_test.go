@@ -0,0 +1,290 @@
+package common
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseSitesConfig(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	sitesConfig, err := ParseSitesConfig([]byte(`
+sites:
+  - name: dns
+    provider: sakuracloud
+    email: test@example.com
+    domains: ["example.com", "*.example.com"]
+    key_type: ec256
+    dual_key_type: rsa2048
+  - name: http
+    challenge: http-01
+    email: test@example.com
+    domains: ["www.example.com"]
+`))
+	require.Nil(err)
+	require.Len(sitesConfig.Sites, 2)
+	assert.Equal(KeyTypeEC256, sitesConfig.Sites[0].CertKeyType())
+	assert.Equal(DefaultKeyType, sitesConfig.Sites[1].CertKeyType())
+
+	certs := sitesConfig.Certificates()
+	require.Len(certs, 3)
+	assert.Equal("dns", certs[0].Name)
+	assert.Equal(KeyTypeEC256, certs[0].KeyType)
+	assert.Equal("dns-rsa", certs[1].Name)
+	assert.Equal(KeyTypeRSA2048, certs[1].KeyType)
+	assert.Equal("http", certs[2].Name)
+
+	invalidConfigs := map[string]string{
+		"unknown key type": `
+sites:
+  - name: site
+    provider: sakuracloud
+    domains: ["example.com"]
+    key_type: ec521
+`,
+		"same algorithm for dual key type": `
+sites:
+  - name: site
+    provider: sakuracloud
+    domains: ["example.com"]
+    key_type: rsa2048
+    dual_key_type: rsa4096
+`,
+		"duplicate dual certificate name": `
+sites:
+  - name: site
+    provider: sakuracloud
+    domains: ["example.com"]
+    key_type: ec256
+    dual_key_type: rsa2048
+  - name: site-rsa
+    provider: sakuracloud
+    domains: ["example.net"]
+`,
+		"invalid ca_dir": `
+sites:
+  - name: site
+    provider: sakuracloud
+    domains: ["example.com"]
+    ca_dir: ca.internal/directory
+`,
+		"duplicate name": `
+sites:
+  - name: site
+    provider: sakuracloud
+    domains: ["example.com"]
+  - name: site
+    provider: sakuracloud
+    domains: ["example.net"]
+`,
+		"duplicate domain": `
+sites:
+  - name: site
+    provider: sakuracloud
+    domains: ["example.com", "EXAMPLE.com"]
+`,
+		"wildcard with http-01": `
+sites:
+  - name: site
+    challenge: http-01
+    domains: ["*.example.com"]
+`,
+		"missing provider": `
+sites:
+  - name: site
+    domains: ["example.com"]
+`,
+		"lego provider without a factory": `
+sites:
+  - name: site
+    provider: duckdns
+    domains: ["example.com"]
+`,
+		"tlsa with a provider without records": `
+sites:
+  - name: site
+    provider: sakuracloud
+    domains: ["example.com"]
+    tlsa: {}
+`,
+		"domain_providers with a domain not in the site": `
+sites:
+  - name: site
+    provider: sakuracloud
+    domains: ["example.com"]
+    domain_providers:
+      - domains: ["example.net"]
+        provider: route53
+`,
+		"domain_providers splitting a wildcard": `
+sites:
+  - name: site
+    provider: sakuracloud
+    domains: ["example.com", "*.example.com"]
+    domain_providers:
+      - domains: ["*.example.com"]
+        provider: route53
+`,
+		"challenge_alias with the challenge label": `
+sites:
+  - name: site
+    provider: sakuracloud
+    domains: ["example.com"]
+    challenge_alias: _acme-challenge.validation.example.net
+`,
+		"propagation with http-01": `
+sites:
+  - name: site
+    challenge: http-01
+    domains: ["example.com"]
+    propagation:
+      wait: 60s
+`,
+		"propagation wait with checks": `
+sites:
+  - name: site
+    provider: sakuracloud
+    domains: ["example.com"]
+    propagation:
+      nameservers: ["10.0.0.53"]
+      wait: 60s
+`,
+		"propagation nameserver by name": `
+sites:
+  - name: site
+    provider: sakuracloud
+    domains: ["example.com"]
+    propagation:
+      nameservers: ["ns.example.com"]
+`,
+		"rotate_key_every without reuse_key": `
+sites:
+  - name: site
+    provider: sakuracloud
+    domains: ["example.com"]
+    rotate_key_every: 90d
+`,
+	}
+	for name, config := range invalidConfigs {
+		_, err := ParseSitesConfig([]byte(config))
+		assert.Error(err, name)
+	}
+}
+
+func TestExternalAccountBinding(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	hmacFile, err := ioutil.TempFile("", "eab-hmac")
+	require.Nil(err)
+	defer os.Remove(hmacFile.Name())
+	_, err = hmacFile.WriteString("file-hmac\n")
+	require.Nil(err)
+	hmacFile.Close()
+
+	sitesConfig, err := ParseSitesConfig([]byte(`
+cas:
+  - directory: https://acme.zerossl.com/v2/DV90
+    eab_kid: ca-kid
+    eab_hmac_file: ` + hmacFile.Name() + `
+sites:
+  - name: ca
+    provider: sakuracloud
+    domains: ["example.com"]
+  - name: site
+    provider: sakuracloud
+    domains: ["example.net"]
+    eab_kid: site-kid
+    eab_hmac: site-hmac
+`))
+	require.Nil(err)
+
+	zeroSsl := "https://acme.zerossl.com/v2/DV90"
+	eab := sitesConfig.ExternalAccountBinding(sitesConfig.Sites[0], zeroSsl)
+	require.NotNil(eab)
+	assert.Equal("ca-kid", eab.EabKid)
+	hmac, err := eab.Hmac()
+	require.Nil(err)
+	assert.Equal("file-hmac", hmac)
+
+	assert.Nil(sitesConfig.ExternalAccountBinding(sitesConfig.Sites[0], "https://acme-v02.api.letsencrypt.org/directory"))
+
+	eab = sitesConfig.ExternalAccountBinding(sitesConfig.Sites[1], zeroSsl)
+	require.NotNil(eab)
+	assert.Equal("site-kid", eab.EabKid)
+	hmac, err = eab.Hmac()
+	require.Nil(err)
+	assert.Equal("site-hmac", hmac)
+
+	_, err = ParseSitesConfig([]byte(`
+sites:
+  - name: site
+    provider: sakuracloud
+    domains: ["example.net"]
+    eab_kid: site-kid
+`))
+	assert.Error(err)
+}
+
+func TestParseRenewBefore(t *testing.T) {
+	assert := assert.New(t)
+	notBefore := time.Now()
+	notAfter := notBefore.Add(6 * 24 * time.Hour)
+
+	policy, err := ParseRenewBefore("33.5%")
+	assert.Nil(err)
+	assert.Equal(time.Duration(0.335*float64(6*24*time.Hour)), policy.Before(notBefore, notAfter))
+
+	policy, err = ParseRenewBefore("90m")
+	assert.Nil(err)
+	assert.Equal(90*time.Minute, policy.Before(notBefore, notAfter))
+
+	policy, err = ParseRenewBefore("1.5d")
+	assert.Nil(err)
+	assert.Equal(36*time.Hour, policy.Before(notBefore, notAfter))
+
+	for _, value := range []string{"", "0%", "100%", "abc%", "-1h", "10", "xd"} {
+		_, err = ParseRenewBefore(value)
+		assert.NotNil(err, value)
+	}
+}
+
+func TestDNSProviders(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	sitesConfig, err := ParseSitesConfig([]byte(`
+sites:
+  - name: mixed
+    provider: cloudflare
+    domains: ["example.com", "*.example.com", "example.net"]
+    legoenv: ["CLOUDFLARE_DNS_API_TOKEN=token"]
+    domain_providers:
+      - domains: ["example.net"]
+        provider: route53
+        legoenv: ["AWS_ACCESS_KEY_ID=id", "AWS_SECRET_ACCESS_KEY=secret"]
+  - name: mapped
+    domains: ["example.org"]
+    domain_providers:
+      - domains: ["example.org"]
+        provider: route53
+`))
+	require.Nil(err)
+
+	providers := sitesConfig.Sites[0].DNSProviders()
+	require.Len(providers, 2)
+	assert.Equal("cloudflare", providers[0].Provider)
+	assert.Equal([]string{"example.com", "*.example.com"}, providers[0].Domains)
+	assert.Equal("route53", providers[1].Provider)
+	assert.Equal([]string{"example.net"}, providers[1].Domains)
+
+	// the provider of the site is not required when every domain is mapped
+	providers = sitesConfig.Sites[1].DNSProviders()
+	require.Len(providers, 1)
+	assert.Equal("route53", providers[0].Provider)
+}
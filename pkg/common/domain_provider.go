@@ -0,0 +1,112 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kamijin-fanta/envoy-acme/pkg/dns_provider"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// DomainProvider is the DNS provider of some domains of a site, for sites whose zones are hosted at several providers.
+type DomainProvider struct {
+	Domains  []string `yaml:"domains" json:"domains"`
+	Provider string   `yaml:"provider" json:"provider"`
+	LegoEnv  []string `yaml:"legoenv" json:"legoenv"`
+	// ChallengeAlias is the domain the challenges are delegated to with CNAMEs, see Site.ChallengeAlias
+	ChallengeAlias string `yaml:"challenge_alias" json:"challenge_alias"`
+}
+
+func (d *DomainProvider) Validate() error {
+	if d.Provider == "" {
+		return errors.New("provider is required for dns-01 challenge")
+	}
+	if !dns_provider.Supported(d.Provider) {
+		return fmt.Errorf("unsupported provider '%s', must be one of %s", d.Provider, strings.Join(dns_provider.Providers(), ", "))
+	}
+	_, err := dns_provider.ParseEnv(d.LegoEnv)
+	if err != nil {
+		return fmt.Errorf("legoenv: %w", err)
+	}
+	if d.ChallengeAlias != "" {
+		if strings.HasPrefix(d.ChallengeAlias, "_acme-challenge.") {
+			return fmt.Errorf("challenge_alias '%s' must be the domain without _acme-challenge", d.ChallengeAlias)
+		}
+		if _, ok := dns.IsDomainName(d.ChallengeAlias); !ok || strings.Contains(d.ChallengeAlias, "*") {
+			return fmt.Errorf("invalid challenge_alias '%s'", d.ChallengeAlias)
+		}
+	}
+	return nil
+}
+
+// DNSProviders returns the DNS providers of the site with the domains they write the challenges for.
+// The provider of the site comes first with the domains not listed in domain_providers, and is omitted when there is none.
+func (s *Site) DNSProviders() []*DomainProvider {
+	var providers []*DomainProvider
+	if site := s.siteDNSProvider(); len(site.Domains) != 0 {
+		providers = append(providers, site)
+	}
+	return append(providers, s.DomainProviders...)
+}
+
+// siteDNSProvider returns the provider of the site with the domains not listed in domain_providers.
+func (s *Site) siteDNSProvider() *DomainProvider {
+	mapped := map[string]bool{}
+	for _, dp := range s.DomainProviders {
+		for _, domain := range dp.Domains {
+			mapped[strings.ToLower(domain)] = true
+		}
+	}
+	site := &DomainProvider{
+		Provider:       s.Provider,
+		LegoEnv:        s.LegoEnv,
+		ChallengeAlias: s.ChallengeAlias,
+	}
+	for _, domain := range s.Domains {
+		if !mapped[strings.ToLower(domain)] {
+			site.Domains = append(site.Domains, domain)
+		}
+	}
+	return site
+}
+
+// validateDomainProviders checks that every domain_providers entry lists domains of the site,
+// and that a domain and its wildcard use the same provider, because they share the challenge record.
+func (s *Site) validateDomainProviders() error {
+	siteDomains := map[string]bool{}
+	for _, domain := range s.Domains {
+		siteDomains[strings.ToLower(domain)] = true
+	}
+	seen := map[string]bool{}
+	for i, dp := range s.DomainProviders {
+		if dp == nil || len(dp.Domains) == 0 {
+			return fmt.Errorf("domain_providers[%d]: domains is required", i)
+		}
+		for _, domain := range dp.Domains {
+			domain = strings.ToLower(domain)
+			if !siteDomains[domain] {
+				return fmt.Errorf("domain_providers[%d]: '%s' is not a domain of the site", i, domain)
+			}
+			if seen[domain] {
+				return fmt.Errorf("domain_providers[%d]: duplicate domain '%s'", i, domain)
+			}
+			seen[domain] = true
+		}
+		err := dp.Validate()
+		if err != nil {
+			return fmt.Errorf("domain_providers[%d]: %w", i, err)
+		}
+	}
+
+	challengeProvider := map[string]*DomainProvider{}
+	for _, dp := range s.DNSProviders() {
+		for _, domain := range dp.Domains {
+			name := strings.TrimPrefix(strings.ToLower(domain), "*.")
+			if other, ok := challengeProvider[name]; ok && other != dp {
+				return fmt.Errorf("'%s' and '*.%s' must use the same provider", name, name)
+			}
+			challengeProvider[name] = dp
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// CertificateAuthority holds settings shared by every site which uses the ACME directory.
+type CertificateAuthority struct {
+	Directory string `yaml:"directory"`
+	ExternalAccountBinding
+}
+
+// ExternalAccountBinding binds new ACME accounts to an existing account at the CA.
+// It is required by e.g. ZeroSSL and Google Trust Services.
+type ExternalAccountBinding struct {
+	EabKid      string `yaml:"eab_kid" json:"eab_kid"`
+	EabHmac     string `yaml:"eab_hmac" json:"eab_hmac"`
+	EabHmacFile string `yaml:"eab_hmac_file" json:"eab_hmac_file"`
+}
+
+func (e *ExternalAccountBinding) Enabled() bool {
+	return e.EabKid != ""
+}
+
+func (e *ExternalAccountBinding) Validate() error {
+	if e.EabHmac != "" && e.EabHmacFile != "" {
+		return errors.New("eab_hmac and eab_hmac_file are exclusive")
+	}
+	hasHmac := e.EabHmac != "" || e.EabHmacFile != ""
+	if e.Enabled() && !hasHmac {
+		return errors.New("eab_hmac or eab_hmac_file is required with eab_kid")
+	}
+	if !e.Enabled() && hasHmac {
+		return errors.New("eab_kid is required with eab_hmac")
+	}
+	return nil
+}
+
+// Hmac returns the base64url encoded HMAC key, which is read from EabHmacFile if specified.
+func (e *ExternalAccountBinding) Hmac() (string, error) {
+	if e.EabHmacFile == "" {
+		return e.EabHmac, nil
+	}
+	content, err := ioutil.ReadFile(e.EabHmacFile)
+	if err != nil {
+		return "", fmt.Errorf("error read eab_hmac_file %w", err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
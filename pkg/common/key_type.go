@@ -0,0 +1,83 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+)
+
+const (
+	KeyTypeEC256   = "ec256"
+	KeyTypeEC384   = "ec384"
+	KeyTypeRSA2048 = "rsa2048"
+	KeyTypeRSA3072 = "rsa3072"
+	KeyTypeRSA4096 = "rsa4096"
+
+	// DefaultKeyType is used when key_type is not specified. It was the only key type in earlier versions.
+	DefaultKeyType = KeyTypeRSA2048
+)
+
+var KeyTypes = []string{KeyTypeEC256, KeyTypeEC384, KeyTypeRSA2048, KeyTypeRSA3072, KeyTypeRSA4096}
+
+func ValidKeyType(keyType string) bool {
+	for _, k := range KeyTypes {
+		if k == keyType {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyAlgorithm returns "ecdsa" or "rsa" for the key type.
+func KeyAlgorithm(keyType string) string {
+	switch keyType {
+	case KeyTypeEC256, KeyTypeEC384:
+		return "ecdsa"
+	default:
+		return "rsa"
+	}
+}
+
+// KeyTypeOf returns the key type of the private key, or an empty string if it is not one of KeyTypes.
+func KeyTypeOf(privateKey crypto.PrivateKey) string {
+	switch key := privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		switch key.Curve.Params().BitSize {
+		case 256:
+			return KeyTypeEC256
+		case 384:
+			return KeyTypeEC384
+		}
+	case *rsa.PrivateKey:
+		switch key.N.BitLen() {
+		case 2048:
+			return KeyTypeRSA2048
+		case 3072:
+			return KeyTypeRSA3072
+		case 4096:
+			return KeyTypeRSA4096
+		}
+	}
+	return ""
+}
+
+// GeneratePrivateKey generates a certificate private key of the key type.
+func GeneratePrivateKey(keyType string) (crypto.PrivateKey, error) {
+	switch keyType {
+	case KeyTypeEC256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEC384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeyTypeRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	default:
+		return nil, fmt.Errorf("unknown key type '%s'", keyType)
+	}
+}
@@ -0,0 +1,78 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Propagation is how the dns-01 challenge records of a site are checked before the ca validates them.
+// The settings of lego and of the dns provider are used for the fields not specified.
+type Propagation struct {
+	// Nameservers are the recursive resolvers used for the checks, instead of the resolvers of /etc/resolv.conf.
+	Nameservers []string `yaml:"nameservers" json:"nameservers"`
+	// CheckAuthoritative checks the record on every authoritative nameserver of the zone. true when not specified.
+	CheckAuthoritative *bool  `yaml:"check_authoritative" json:"check_authoritative"`
+	Timeout            string `yaml:"timeout" json:"timeout"`
+	Interval           string `yaml:"interval" json:"interval"`
+	// Wait disables the checks, and waits the duration after the records are written.
+	Wait string `yaml:"wait" json:"wait"`
+}
+
+func (p *Propagation) Validate() error {
+	for _, nameserver := range p.Nameservers {
+		host := nameserver
+		if h, _, err := net.SplitHostPort(nameserver); err == nil {
+			host = h
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("nameserver '%s' must be an ip address", nameserver)
+		}
+	}
+	for name, value := range map[string]string{"timeout": p.Timeout, "interval": p.Interval, "wait": p.Wait} {
+		if value == "" {
+			continue
+		}
+		_, err := ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if p.Wait != "" && (len(p.Nameservers) != 0 || p.CheckAuthoritative != nil || p.Timeout != "" || p.Interval != "") {
+		return errors.New("wait disables the checks, and can not be used with the other settings")
+	}
+	return nil
+}
+
+// AuthoritativeCheck returns whether the authoritative nameservers are checked.
+func (p *Propagation) AuthoritativeCheck() bool {
+	return p.CheckAuthoritative == nil || *p.CheckAuthoritative
+}
+
+// TimeoutDuration returns the propagation timeout, or 0 when the timeout of the provider is used.
+func (p *Propagation) TimeoutDuration() time.Duration {
+	return optionalDuration(p.Timeout)
+}
+
+// IntervalDuration returns the polling interval, or 0 when the interval of the provider is used.
+func (p *Propagation) IntervalDuration() time.Duration {
+	return optionalDuration(p.Interval)
+}
+
+// WaitDuration returns how long to wait instead of the checks, or 0 when the records are checked.
+func (p *Propagation) WaitDuration() time.Duration {
+	return optionalDuration(p.Wait)
+}
+
+func optionalDuration(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	duration, err := ParseDuration(value)
+	if err != nil {
+		// rejected by Validate
+		return 0
+	}
+	return duration
+}
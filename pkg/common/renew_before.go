@@ -0,0 +1,66 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RenewBefore is the renewal policy of a site, how long before the expiration the certificate is renewed.
+// It is either a fraction of the lifetime of the certificate, or a fixed duration.
+type RenewBefore struct {
+	Fraction float64
+	Duration time.Duration
+}
+
+// ParseRenewBefore parses the renew_before setting of a site.
+// "33%" renews when less than 33% of the validity remains, "36h" or "10d" when less than the duration remains.
+func ParseRenewBefore(value string) (*RenewBefore, error) {
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid percentage '%s'", value)
+		}
+		if percent <= 0 || percent >= 100 {
+			return nil, fmt.Errorf("percentage '%s' must be between 0%% and 100%%", value)
+		}
+		return &RenewBefore{Fraction: percent / 100}, nil
+	}
+
+	duration, err := ParseDuration(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w, or a percentage like '33%%'", err)
+	}
+	return &RenewBefore{Duration: duration}, nil
+}
+
+// ParseDuration parses a positive duration of the site config, days like "10d" or a duration like "36h".
+func ParseDuration(value string) (time.Duration, error) {
+	var duration time.Duration
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(value, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid days '%s'", value)
+		}
+		duration = time.Duration(days * float64(24*time.Hour))
+	} else {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration '%s', must be days like '10d' or a duration like '36h'", value)
+		}
+		duration = d
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("duration '%s' must be positive", value)
+	}
+	return duration, nil
+}
+
+// Before returns how long before NotAfter a certificate valid from notBefore to notAfter is renewed.
+func (r *RenewBefore) Before(notBefore, notAfter time.Time) time.Duration {
+	if r.Fraction != 0 {
+		return time.Duration(r.Fraction * float64(notAfter.Sub(notBefore)))
+	}
+	return r.Duration
+}
@@ -0,0 +1,44 @@
+package common
+
+import (
+	"fmt"
+	"time"
+)
+
+const DefaultTlsaTTL = 3600
+
+var DefaultTlsaPorts = []int{443}
+
+// Tlsa is the DANE TLSA records of a site, which are published through the dns provider of the site.
+type Tlsa struct {
+	Ports []int `yaml:"ports" json:"ports"`
+	TTL   int   `yaml:"ttl" json:"ttl"`
+}
+
+func (t *Tlsa) Validate() error {
+	for _, port := range t.Ports {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	if t.TTL < 0 {
+		return fmt.Errorf("invalid ttl %d", t.TTL)
+	}
+	return nil
+}
+
+// TlsaPorts returns the ports the records are published for. 443 is used when not specified.
+func (t *Tlsa) TlsaPorts() []int {
+	if len(t.Ports) == 0 {
+		return DefaultTlsaPorts
+	}
+	return t.Ports
+}
+
+// RecordTTL returns the TTL of the records. A new key is used only after the TTL has elapsed since it was published.
+func (t *Tlsa) RecordTTL() time.Duration {
+	if t.TTL == 0 {
+		return DefaultTlsaTTL * time.Second
+	}
+	return time.Duration(t.TTL) * time.Second
+}
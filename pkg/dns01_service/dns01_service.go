@@ -0,0 +1,216 @@
+package dns01_service
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	dns01RequestCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: common.PrometheusNamespace,
+		Name:      "dns01_request",
+	}, []string{"result"})
+)
+
+const (
+	// recordTTL is the TTL of the answers, short so that resolvers never serve a challenge of the last order
+	recordTTL = 10
+	// negativeTTL is the SOA minimum, how long resolvers cache that a challenge does not exist
+	negativeTTL = 10
+)
+
+var _ challenge.Provider = &Provider{}
+
+// Provider presents dns-01 challenges by writing them to the store.
+// They are answered by any Dns01Service sharing the same store.
+type Provider struct {
+	store store.Store
+}
+
+func NewProvider(store store.Store) *Provider {
+	return &Provider{
+		store: store,
+	}
+}
+
+func (p *Provider) Present(domain, token, keyAuth string) error {
+	return p.store.WriteChallenge(&store.Challenge{
+		Type:    string(challenge.DNS01),
+		Domain:  strings.ToLower(domain),
+		Token:   token,
+		KeyAuth: keyAuth,
+	})
+}
+
+func (p *Provider) CleanUp(domain, token, keyAuth string) error {
+	return p.store.DeleteChallenge(string(challenge.DNS01), token)
+}
+
+var _ dns.Handler = &Dns01Service{}
+
+// Dns01Service is an authoritative DNS server of the zones delegated to envoy-acme,
+// which answers the TXT records of the dns-01 challenges in the store.
+type Dns01Service struct {
+	store       store.Store
+	zones       []string
+	nameservers []string
+	logger      *logrus.Entry
+}
+
+// NewDns01Service creates the server of the zones. The nameservers are the names of the hosts serving the zones,
+// answered as the NS records of the zones.
+func NewDns01Service(store store.Store, zones, nameservers []string, logger *logrus.Logger) *Dns01Service {
+	d := &Dns01Service{
+		store:  store,
+		logger: logger.WithField("component", "dns01_service"),
+	}
+	for _, zone := range zones {
+		d.zones = append(d.zones, strings.ToLower(dns.Fqdn(zone)))
+	}
+	for _, ns := range nameservers {
+		d.nameservers = append(d.nameservers, strings.ToLower(dns.Fqdn(ns)))
+	}
+	return d
+}
+
+// RunServer serves the queries on udp and tcp, and returns when one of them stops.
+func (d *Dns01Service) RunServer(conn net.PacketConn, listener net.Listener) error {
+	d.logger.WithField("addr", conn.LocalAddr().String()).WithField("zones", d.zones).Info("start server")
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- (&dns.Server{PacketConn: conn, Handler: d}).ActivateAndServe()
+	}()
+	go func() {
+		errCh <- (&dns.Server{Listener: listener, Handler: d}).ActivateAndServe()
+	}()
+	return <-errCh
+}
+
+func (d *Dns01Service) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if len(r.Question) != 1 {
+		dns01RequestCounter.WithLabelValues("invalid").Inc()
+		m.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	requestLogger := d.logger.WithField("name", name).WithField("type", dns.TypeToString[q.Qtype])
+
+	zone := d.zoneOf(name)
+	if zone == "" {
+		requestLogger.Debug("name out of zones")
+		dns01RequestCounter.WithLabelValues("refused").Inc()
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+	m.Authoritative = true
+
+	values, err := d.challengeValues(name)
+	if err != nil {
+		requestLogger.WithError(err).Warn("error on list challenges")
+		dns01RequestCounter.WithLabelValues("error").Inc()
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+
+	switch {
+	case name == zone && q.Qtype == dns.TypeSOA:
+		m.Answer = append(m.Answer, d.soa(zone))
+	case name == zone && q.Qtype == dns.TypeNS:
+		for _, ns := range d.nameservers {
+			m.Answer = append(m.Answer, &dns.NS{
+				Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600},
+				Ns:  ns,
+			})
+		}
+	case q.Qtype == dns.TypeTXT:
+		for _, value := range values {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: recordTTL},
+				Txt: []string{value},
+			})
+		}
+	}
+
+	if len(m.Answer) == 0 {
+		m.Ns = append(m.Ns, d.soa(zone))
+		if name != zone && len(values) == 0 {
+			m.Rcode = dns.RcodeNameError
+		}
+	}
+	if len(values) != 0 && q.Qtype == dns.TypeTXT {
+		requestLogger.Info("serve dns-01 challenge")
+		dns01RequestCounter.WithLabelValues("success").Inc()
+	} else {
+		dns01RequestCounter.WithLabelValues("not_found").Inc()
+	}
+	w.WriteMsg(m)
+}
+
+// zoneOf returns the longest zone the name belongs to, or empty when the server is not authoritative for it.
+func (d *Dns01Service) zoneOf(name string) string {
+	matched := ""
+	for _, zone := range d.zones {
+		if dns.IsSubDomain(zone, name) && len(zone) > len(matched) {
+			matched = zone
+		}
+	}
+	return matched
+}
+
+// challengeValues returns the TXT values of the challenges presented at the name.
+func (d *Dns01Service) challengeValues(name string) ([]string, error) {
+	if !strings.HasPrefix(name, "_acme-challenge.") {
+		return nil, nil
+	}
+	challenges, err := d.store.ListChallenges(string(challenge.DNS01))
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, chlg := range challenges {
+		if "_acme-challenge."+dns.Fqdn(chlg.Domain) == name {
+			values = append(values, challengeValue(chlg.KeyAuth))
+		}
+	}
+	return values, nil
+}
+
+func (d *Dns01Service) soa(zone string) dns.RR {
+	mname := "ns." + zone
+	if len(d.nameservers) != 0 {
+		mname = d.nameservers[0]
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: negativeTTL},
+		Ns:      mname,
+		Mbox:    "hostmaster." + zone,
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  negativeTTL,
+	}
+}
+
+// challengeValue returns the TXT value of the key authorization, see RFC 8555 section 8.4.
+// dns01.GetRecord of lego is not used, because it may look up CNAMEs.
+func challengeValue(keyAuth string) string {
+	sum := sha256.Sum256([]byte(keyAuth))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
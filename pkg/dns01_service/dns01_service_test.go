@@ -0,0 +1,76 @@
+package dns01_service
+
+import (
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/kamijin-fanta/envoy-acme/pkg/dns_provider"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store/file_store"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestDns01Service(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "acme-dns01")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+	fileStore, err := file_store.NewFileStore(tmpDir)
+	require.Nil(err)
+
+	service := NewDns01Service(fileStore, []string{"acme.example.com"}, []string{"ns1.example.com"}, logrus.New())
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	go service.RunServer(conn, listener)
+	addr := conn.LocalAddr().String()
+
+	query := func(name string, rrtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, rrtype)
+		reply, _, err := (&dns.Client{}).Exchange(m, addr)
+		require.Nil(err)
+		return reply
+	}
+
+	provider := NewProvider(fileStore)
+	require.Nil(provider.Present("www.example.com.acme.example.com", "token1", "key-auth1"))
+	require.Nil(provider.Present("www.example.com.acme.example.com", "token2", "key-auth2"))
+
+	reply := query("_acme-challenge.www.example.com.acme.example.com.", dns.TypeTXT)
+	assert.True(reply.Authoritative)
+	require.Len(reply.Answer, 2)
+	_, value := dns01.GetRecord("www.example.com.acme.example.com", "key-auth1")
+	assert.Contains([]string{reply.Answer[0].(*dns.TXT).Txt[0], reply.Answer[1].(*dns.TXT).Txt[0]}, value)
+
+	// the resolver of the propagation check sees the challenge
+	checker, err := dns_provider.NewPropagationCheck([]string{addr}, false)
+	require.Nil(err)
+	ok, err := checker.Check("_acme-challenge.www.example.com.acme.example.com.", value)
+	assert.Nil(err)
+	assert.True(ok)
+
+	require.Nil(provider.CleanUp("www.example.com.acme.example.com", "token1", "key-auth1"))
+	reply = query("_acme-challenge.www.example.com.acme.example.com.", dns.TypeTXT)
+	assert.Len(reply.Answer, 1)
+
+	reply = query("acme.example.com.", dns.TypeSOA)
+	require.Len(reply.Answer, 1)
+	assert.Equal("ns1.example.com.", reply.Answer[0].(*dns.SOA).Ns)
+	reply = query("acme.example.com.", dns.TypeNS)
+	require.Len(reply.Answer, 1)
+	assert.Equal("ns1.example.com.", reply.Answer[0].(*dns.NS).Ns)
+
+	reply = query("_acme-challenge.other.acme.example.com.", dns.TypeTXT)
+	assert.Equal(dns.RcodeNameError, reply.Rcode)
+	assert.Len(reply.Ns, 1)
+	reply = query("_acme-challenge.example.net.", dns.TypeTXT)
+	assert.Equal(dns.RcodeRefused, reply.Rcode)
+}
@@ -0,0 +1,128 @@
+package dns_provider
+
+import (
+	"errors"
+	"fmt"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/miekg/dns"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// cloudflareRecords writes records with the api of cloudflare, with the same settings as the cloudflare provider.
+type cloudflareRecords struct {
+	api *cf.API
+	// zoneApi looks up the zone ids, with CLOUDFLARE_ZONE_API_TOKEN when it is set
+	zoneApi  *cf.API
+	findZone func(fqdn string) (string, error)
+}
+
+func newCloudflareRecords(env Env) (RecordWriter, error) {
+	email := env.GetOrDefaultString("CLOUDFLARE_EMAIL", env.Value("CF_API_EMAIL"))
+	key := env.GetOrDefaultString("CLOUDFLARE_API_KEY", env.Value("CF_API_KEY"))
+	token := env.GetOrDefaultString("CLOUDFLARE_DNS_API_TOKEN", env.Value("CF_DNS_API_TOKEN"))
+	zoneToken := env.GetOrDefaultString("CLOUDFLARE_ZONE_API_TOKEN", env.GetOrDefaultString("CF_ZONE_API_TOKEN", token))
+	client := cf.HTTPClient(&http.Client{
+		Timeout: env.GetOrDefaultSecond("CLOUDFLARE_HTTP_TIMEOUT", 30*time.Second),
+	})
+
+	if token == "" {
+		if email == "" || key == "" {
+			return nil, errors.New("CLOUDFLARE_DNS_API_TOKEN or CLOUDFLARE_EMAIL and CLOUDFLARE_API_KEY are required")
+		}
+		api, err := cf.New(key, email, client)
+		if err != nil {
+			return nil, err
+		}
+		return &cloudflareRecords{api: api, zoneApi: api, findZone: dns01.FindZoneByFqdn}, nil
+	}
+
+	api, err := cf.NewWithAPIToken(token, client)
+	if err != nil {
+		return nil, err
+	}
+	zoneApi := api
+	if zoneToken != token {
+		zoneApi, err = cf.NewWithAPIToken(zoneToken, client)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &cloudflareRecords{api: api, zoneApi: zoneApi, findZone: dns01.FindZoneByFqdn}, nil
+}
+
+// ReplaceRecords creates the missing records before deleting the stale ones,
+// so that the name never resolves to an empty record set while the records are replaced.
+func (c *cloudflareRecords) ReplaceRecords(fqdn string, rrtype uint16, rrs []dns.RR) error {
+	zone, err := c.findZone(fqdn)
+	if err != nil {
+		return err
+	}
+	zoneId, err := c.zoneApi.ZoneIDByName(dns01.UnFqdn(zone))
+	if err != nil {
+		return fmt.Errorf("cloudflare: zone %s %w", zone, err)
+	}
+
+	name := dns01.UnFqdn(strings.ToLower(fqdn))
+	existing, err := c.api.DNSRecords(zoneId, cf.DNSRecord{Name: name, Type: dns.TypeToString[rrtype]})
+	if err != nil {
+		return fmt.Errorf("cloudflare: list records %w", err)
+	}
+	current := map[string]bool{}
+	for _, record := range existing {
+		current[strings.ToLower(record.Content)] = true
+	}
+
+	desired := map[string]bool{}
+	for _, rr := range rrs {
+		record := cloudflareRecord(name, rr)
+		desired[strings.ToLower(record.Content)] = true
+		if current[strings.ToLower(record.Content)] {
+			continue
+		}
+		_, err = c.api.CreateDNSRecord(zoneId, record)
+		if err != nil {
+			return fmt.Errorf("cloudflare: create record %w", err)
+		}
+	}
+	for _, record := range existing {
+		if desired[strings.ToLower(record.Content)] {
+			continue
+		}
+		err = c.api.DeleteDNSRecord(zoneId, record.ID)
+		if err != nil {
+			return fmt.Errorf("cloudflare: delete record %w", err)
+		}
+	}
+	return nil
+}
+
+// cloudflareRecord converts the record to the api. Content is the rdata in the presentation format
+// the api returns, e.g. "3 1 1 <digest>" of TLSA. TLSA is created with its fields in data.
+func cloudflareRecord(name string, rr dns.RR) cf.DNSRecord {
+	record := cf.DNSRecord{
+		Type:    dns.TypeToString[rr.Header().Rrtype],
+		Name:    name,
+		Content: rdata(rr),
+		TTL:     int(rr.Header().Ttl),
+	}
+	switch rr := rr.(type) {
+	case *dns.TXT:
+		record.Content = strings.Join(rr.Txt, "")
+	case *dns.TLSA:
+		record.Data = map[string]interface{}{
+			"usage":         rr.Usage,
+			"selector":      rr.Selector,
+			"matching_type": rr.MatchingType,
+			"certificate":   rr.Certificate,
+		}
+	}
+	return record
+}
+
+// rdata returns the data of the record in the presentation format, e.g. `"value"` of TXT.
+func rdata(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
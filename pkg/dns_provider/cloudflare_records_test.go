@@ -0,0 +1,106 @@
+package dns_provider
+
+import (
+	"encoding/json"
+	"fmt"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCloudflare serves the zones and dns records endpoints of the cloudflare api for one zone.
+type fakeCloudflare struct {
+	mutex   sync.Mutex
+	records map[string]cf.DNSRecord
+	nextId  int
+	deleted int
+}
+
+func (f *fakeCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	response := map[string]interface{}{
+		"success":     true,
+		"result_info": map[string]int{"page": 1, "per_page": 100, "count": 1, "total_count": 1, "total_pages": 1},
+	}
+	switch {
+	case r.URL.Path == "/zones":
+		response["result"] = []map[string]string{{"id": "zone1", "name": r.URL.Query().Get("name")}}
+	case r.URL.Path == "/zones/zone1/dns_records" && r.Method == http.MethodGet:
+		var records []cf.DNSRecord
+		for _, record := range f.records {
+			if record.Name == r.URL.Query().Get("name") && record.Type == r.URL.Query().Get("type") {
+				records = append(records, record)
+			}
+		}
+		response["result"] = records
+	case r.URL.Path == "/zones/zone1/dns_records" && r.Method == http.MethodPost:
+		var record cf.DNSRecord
+		err := json.NewDecoder(r.Body).Decode(&record)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if data, ok := record.Data.(map[string]interface{}); ok && record.Type == "TLSA" {
+			record.Content = fmt.Sprintf("%v %v %v %v", data["usage"], data["selector"], data["matching_type"], data["certificate"])
+		}
+		f.nextId++
+		record.ID = fmt.Sprintf("record%d", f.nextId)
+		f.records[record.ID] = record
+		response["result"] = record
+	case strings.HasPrefix(r.URL.Path, "/zones/zone1/dns_records/") && r.Method == http.MethodDelete:
+		id := strings.TrimPrefix(r.URL.Path, "/zones/zone1/dns_records/")
+		delete(f.records, id)
+		f.deleted++
+		response["result"] = map[string]string{"id": id}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func TestCloudflareRecords(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	fake := &fakeCloudflare{records: map[string]cf.DNSRecord{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	writer, err := newCloudflareRecords(Env{"CLOUDFLARE_DNS_API_TOKEN": "token"})
+	require.Nil(err)
+	records := writer.(*cloudflareRecords)
+	records.api.BaseURL = server.URL
+	records.findZone = func(fqdn string) (string, error) {
+		return "example.com.", nil
+	}
+
+	tlsa := func(digest string) dns.RR {
+		rr, err := dns.NewRR("_443._tcp.example.com. 300 IN TLSA 3 1 1 " + digest)
+		require.Nil(err)
+		return rr
+	}
+	require.Nil(writer.ReplaceRecords("_443._tcp.example.com.", dns.TypeTLSA, []dns.RR{tlsa("aaaa"), tlsa("bbbb")}))
+	assert.Len(fake.records, 2)
+
+	// the record kept is not deleted and created again
+	require.Nil(writer.ReplaceRecords("_443._tcp.example.com.", dns.TypeTLSA, []dns.RR{tlsa("bbbb"), tlsa("cccc")}))
+	var contents []string
+	for _, record := range fake.records {
+		assert.Equal("_443._tcp.example.com", record.Name)
+		assert.Equal(300, record.TTL)
+		contents = append(contents, record.Content)
+	}
+	assert.ElementsMatch([]string{"3 1 1 bbbb", "3 1 1 cccc"}, contents)
+	assert.Equal(1, fake.deleted)
+
+	require.Nil(writer.ReplaceRecords("_443._tcp.example.com.", dns.TypeTLSA, nil))
+	assert.Empty(fake.records)
+}
@@ -0,0 +1,228 @@
+package dns_provider
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awsroute53 "github.com/aws/aws-sdk-go/service/route53"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/providers/dns/cloudflare"
+	"github.com/go-acme/lego/v4/providers/dns/digitalocean"
+	"github.com/go-acme/lego/v4/providers/dns/exec"
+	"github.com/go-acme/lego/v4/providers/dns/httpreq"
+	"github.com/go-acme/lego/v4/providers/dns/rfc2136"
+	"github.com/go-acme/lego/v4/providers/dns/route53"
+	"github.com/go-acme/lego/v4/providers/dns/sakuracloud"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// factories build the lego DNS providers from explicit settings.
+// The settings use the same names as the environment variables of lego, but the process environment is never used,
+// so that providers of several sites can be created concurrently without leaking credentials between them.
+var factories = map[string]func(env Env) (challenge.Provider, error){
+	"cloudflare":   newCloudflare,
+	"digitalocean": newDigitalocean,
+	"exec":         newExec,
+	"httpreq":      newHttpreq,
+	"rfc2136":      newRfc2136,
+	"route53":      newRoute53,
+	"sakuracloud":  newSakuracloud,
+}
+
+// Embedded is the provider of the embedded DNS server, which writes the challenges to the store.
+// It has no factory, because it is created with the store by the acme service.
+const Embedded = "embedded"
+
+var ErrUnsupportedProvider = errors.New("unsupported dns provider")
+
+// Providers returns the names of the supported providers.
+func Providers() []string {
+	names := make([]string, 0, len(factories)+1)
+	for name := range factories {
+		names = append(names, name)
+	}
+	names = append(names, Embedded)
+	sort.Strings(names)
+	return names
+}
+
+func Supported(name string) bool {
+	_, ok := factories[name]
+	return ok || name == Embedded
+}
+
+// NewDNSProvider creates the DNS provider with the settings of a site.
+func NewDNSProvider(name string, env Env) (challenge.Provider, error) {
+	factory, ok := factories[name]
+	if !ok {
+		return nil, fmt.Errorf("%w '%s'", ErrUnsupportedProvider, name)
+	}
+	env, err := env.ReadFiles()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	provider, err := factory(env)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return provider, nil
+}
+
+func newCloudflare(env Env) (challenge.Provider, error) {
+	config := &cloudflare.Config{
+		AuthEmail:          env.GetOrDefaultString("CLOUDFLARE_EMAIL", env.Value("CF_API_EMAIL")),
+		AuthKey:            env.GetOrDefaultString("CLOUDFLARE_API_KEY", env.Value("CF_API_KEY")),
+		AuthToken:          env.GetOrDefaultString("CLOUDFLARE_DNS_API_TOKEN", env.Value("CF_DNS_API_TOKEN")),
+		TTL:                env.GetOrDefaultInt("CLOUDFLARE_TTL", 120),
+		PropagationTimeout: env.GetOrDefaultSecond("CLOUDFLARE_PROPAGATION_TIMEOUT", 2*time.Minute),
+		PollingInterval:    env.GetOrDefaultSecond("CLOUDFLARE_POLLING_INTERVAL", 2*time.Second),
+		HTTPClient: &http.Client{
+			Timeout: env.GetOrDefaultSecond("CLOUDFLARE_HTTP_TIMEOUT", 30*time.Second),
+		},
+	}
+	config.ZoneToken = env.GetOrDefaultString("CLOUDFLARE_ZONE_API_TOKEN", env.GetOrDefaultString("CF_ZONE_API_TOKEN", config.AuthToken))
+	if config.AuthToken == "" && (config.AuthEmail == "" || config.AuthKey == "") {
+		return nil, errors.New("CLOUDFLARE_DNS_API_TOKEN or CLOUDFLARE_EMAIL and CLOUDFLARE_API_KEY are required")
+	}
+	return cloudflare.NewDNSProviderConfig(config)
+}
+
+func newDigitalocean(env Env) (challenge.Provider, error) {
+	values, err := env.Get("DO_AUTH_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	return digitalocean.NewDNSProviderConfig(&digitalocean.Config{
+		BaseURL:            env.GetOrDefaultString("DO_BASE_URL", "https://api.digitalocean.com"),
+		AuthToken:          values["DO_AUTH_TOKEN"],
+		TTL:                env.GetOrDefaultInt("DO_TTL", 30),
+		PropagationTimeout: env.GetOrDefaultSecond("DO_PROPAGATION_TIMEOUT", 60*time.Second),
+		PollingInterval:    env.GetOrDefaultSecond("DO_POLLING_INTERVAL", 5*time.Second),
+		HTTPClient: &http.Client{
+			Timeout: env.GetOrDefaultSecond("DO_HTTP_TIMEOUT", 30*time.Second),
+		},
+	})
+}
+
+func newExec(env Env) (challenge.Provider, error) {
+	values, err := env.Get("EXEC_PATH")
+	if err != nil {
+		return nil, err
+	}
+	return exec.NewDNSProviderConfig(&exec.Config{
+		Program:            values["EXEC_PATH"],
+		Mode:               env.Value("EXEC_MODE"),
+		PropagationTimeout: env.GetOrDefaultSecond("EXEC_PROPAGATION_TIMEOUT", dns01.DefaultPropagationTimeout),
+		PollingInterval:    env.GetOrDefaultSecond("EXEC_POLLING_INTERVAL", dns01.DefaultPollingInterval),
+	})
+}
+
+func newHttpreq(env Env) (challenge.Provider, error) {
+	values, err := env.Get("HTTPREQ_ENDPOINT")
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := url.Parse(values["HTTPREQ_ENDPOINT"])
+	if err != nil {
+		return nil, err
+	}
+	return httpreq.NewDNSProviderConfig(&httpreq.Config{
+		Endpoint:           endpoint,
+		Mode:               env.Value("HTTPREQ_MODE"),
+		Username:           env.Value("HTTPREQ_USERNAME"),
+		Password:           env.Value("HTTPREQ_PASSWORD"),
+		PropagationTimeout: env.GetOrDefaultSecond("HTTPREQ_PROPAGATION_TIMEOUT", dns01.DefaultPropagationTimeout),
+		PollingInterval:    env.GetOrDefaultSecond("HTTPREQ_POLLING_INTERVAL", dns01.DefaultPollingInterval),
+		HTTPClient: &http.Client{
+			Timeout: env.GetOrDefaultSecond("HTTPREQ_HTTP_TIMEOUT", 30*time.Second),
+		},
+	})
+}
+
+func newRfc2136(env Env) (challenge.Provider, error) {
+	values, err := env.Get("RFC2136_NAMESERVER")
+	if err != nil {
+		return nil, err
+	}
+	return rfc2136.NewDNSProviderConfig(&rfc2136.Config{
+		Nameserver:         values["RFC2136_NAMESERVER"],
+		TSIGAlgorithm:      env.GetOrDefaultString("RFC2136_TSIG_ALGORITHM", dns.HmacMD5),
+		TSIGKey:            env.Value("RFC2136_TSIG_KEY"),
+		TSIGSecret:         env.Value("RFC2136_TSIG_SECRET"),
+		TTL:                env.GetOrDefaultInt("RFC2136_TTL", dns01.DefaultTTL),
+		PropagationTimeout: env.GetOrDefaultSecond("RFC2136_PROPAGATION_TIMEOUT", env.GetOrDefaultSecond("RFC2136_TIMEOUT", 60*time.Second)),
+		PollingInterval:    env.GetOrDefaultSecond("RFC2136_POLLING_INTERVAL", 2*time.Second),
+		SequenceInterval:   env.GetOrDefaultSecond("RFC2136_SEQUENCE_INTERVAL", dns01.DefaultPropagationTimeout),
+		DNSTimeout:         env.GetOrDefaultSecond("RFC2136_DNS_TIMEOUT", 10*time.Second),
+	})
+}
+
+func newRoute53(env Env) (challenge.Provider, error) {
+	client, err := newRoute53Client(env)
+	if err != nil {
+		return nil, err
+	}
+	return route53.NewDNSProviderConfig(&route53.Config{
+		MaxRetries:         env.GetOrDefaultInt("AWS_MAX_RETRIES", 5),
+		TTL:                env.GetOrDefaultInt("AWS_TTL", 10),
+		PropagationTimeout: env.GetOrDefaultSecond("AWS_PROPAGATION_TIMEOUT", 2*time.Minute),
+		PollingInterval:    env.GetOrDefaultSecond("AWS_POLLING_INTERVAL", 4*time.Second),
+		HostedZoneID:       env.Value("AWS_HOSTED_ZONE_ID"),
+		Client:             client,
+	})
+}
+
+// newRoute53Client uses the keys of the settings, or the default credential chain of the AWS SDK like lego without them,
+// e.g. the shared config of AWS_PROFILE, the web identity of IRSA or the instance role.
+// The chain reads the environment of the process as it was started, which no provider changes.
+func newRoute53Client(env Env) (*awsroute53.Route53, error) {
+	awsConfig := aws.NewConfig().WithMaxRetries(env.GetOrDefaultInt("AWS_MAX_RETRIES", 5))
+	if region := env.Value("AWS_REGION"); region != "" {
+		awsConfig = awsConfig.WithRegion(region)
+	}
+	accessKey, secretKey := env.Value("AWS_ACCESS_KEY_ID"), env.Value("AWS_SECRET_ACCESS_KEY")
+	if accessKey != "" || secretKey != "" {
+		values, err := env.Get("AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY")
+		if err != nil {
+			return nil, err
+		}
+		awsConfig = awsConfig.WithCredentials(credentials.NewStaticCredentials(values["AWS_ACCESS_KEY_ID"], values["AWS_SECRET_ACCESS_KEY"], env.Value("AWS_SESSION_TOKEN")))
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		Profile:           env.Value("AWS_PROFILE"),
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		// route53 is a global service, the region only selects the endpoint
+		sess.Config.Region = aws.String("us-east-1")
+	}
+	return awsroute53.New(sess), nil
+}
+
+func newSakuracloud(env Env) (challenge.Provider, error) {
+	values, err := env.Get("SAKURACLOUD_ACCESS_TOKEN", "SAKURACLOUD_ACCESS_TOKEN_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	return sakuracloud.NewDNSProviderConfig(&sakuracloud.Config{
+		Token:              values["SAKURACLOUD_ACCESS_TOKEN"],
+		Secret:             values["SAKURACLOUD_ACCESS_TOKEN_SECRET"],
+		TTL:                env.GetOrDefaultInt("SAKURACLOUD_TTL", dns01.DefaultTTL),
+		PropagationTimeout: env.GetOrDefaultSecond("SAKURACLOUD_PROPAGATION_TIMEOUT", dns01.DefaultPropagationTimeout),
+		PollingInterval:    env.GetOrDefaultSecond("SAKURACLOUD_POLLING_INTERVAL", dns01.DefaultPollingInterval),
+		HTTPClient: &http.Client{
+			Timeout: env.GetOrDefaultSecond("SAKURACLOUD_HTTP_TIMEOUT", 10*time.Second),
+		},
+	})
+}
@@ -0,0 +1,103 @@
+package dns_provider
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseEnv(t *testing.T) {
+	assert := assert.New(t)
+
+	env, err := ParseEnv([]string{"KEY=value", "SECRET=base64=="})
+	assert.Nil(err)
+	assert.Equal(Env{"KEY": "value", "SECRET": "base64=="}, env)
+
+	_, err = ParseEnv([]string{"INVALID"})
+	assert.Error(err)
+
+	f, err := ioutil.TempFile("", "secret")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("secret\n")
+	f.Close()
+	env, err = Env{"DO_AUTH_TOKEN_FILE": f.Name(), "RFC2136_TSIG_KEY": "value", "RFC2136_TSIG_KEY_FILE": "/not/found"}.ReadFiles()
+	assert.Nil(err)
+	assert.Equal("secret", env.Value("DO_AUTH_TOKEN"))
+	assert.Equal("value", env.Value("RFC2136_TSIG_KEY"))
+
+	// a wrong path is not taken as an empty credential
+	_, err = Env{"DO_AUTH_TOKEN_FILE": "/not/found"}.ReadFiles()
+	assert.Error(err)
+
+	// settings named *_FILE which are not credentials are kept
+	env, err = Env{"GCE_SERVICE_ACCOUNT_FILE": "/not/found"}.ReadFiles()
+	assert.Nil(err)
+	assert.Equal(Env{"GCE_SERVICE_ACCOUNT_FILE": "/not/found"}, env)
+}
+
+func TestNewDNSProvider(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	os.Unsetenv("RFC2136_NAMESERVER")
+	env := Env{
+		"RFC2136_NAMESERVER":          "127.0.0.1:53",
+		"RFC2136_PROPAGATION_TIMEOUT": "300",
+	}
+	provider, err := NewDNSProvider("rfc2136", env)
+	require.Nil(err)
+	assert.Equal("", os.Getenv("RFC2136_NAMESERVER"))
+
+	timeout, _ := provider.(interface {
+		Timeout() (timeout, interval time.Duration)
+	}).Timeout()
+	assert.Equal(300*time.Second, timeout)
+
+	_, err = NewDNSProvider("sakuracloud", Env{})
+	assert.Error(err)
+
+	_, err = NewDNSProvider("unknown", Env{})
+	assert.True(errors.Is(err, ErrUnsupportedProvider))
+
+	// route53 uses the default credential chain of the AWS SDK without keys
+	_, err = NewDNSProvider("route53", Env{})
+	assert.Nil(err)
+	_, err = NewDNSProvider("route53", Env{"AWS_ACCESS_KEY_ID": "key"})
+	assert.Error(err)
+
+	// the providers of lego without a factory would read the process environment
+	_, err = NewDNSProvider("duckdns", Env{"DUCKDNS_TOKEN": "token"})
+	assert.True(errors.Is(err, ErrUnsupportedProvider))
+	assert.False(Supported("duckdns"))
+}
+
+func TestNewRecordWriter(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	writer, err := NewRecordWriter("rfc2136", Env{"RFC2136_NAMESERVER": "127.0.0.1"})
+	require.Nil(err)
+	assert.Equal("127.0.0.1:53", writer.(*rfc2136Records).nameserver)
+
+	_, err = NewRecordWriter("rfc2136", Env{})
+	assert.Error(err)
+
+	writer, err = NewRecordWriter("cloudflare", Env{"CF_DNS_API_TOKEN": "token"})
+	require.Nil(err)
+	assert.Equal("token", writer.(*cloudflareRecords).zoneApi.APIToken)
+	_, err = NewRecordWriter("cloudflare", Env{"CLOUDFLARE_EMAIL": "admin@example.com"})
+	assert.Error(err)
+
+	writer, err = NewRecordWriter("route53", Env{"AWS_HOSTED_ZONE_ID": "Z1", "AWS_ACCESS_KEY_ID": "key", "AWS_SECRET_ACCESS_KEY": "secret"})
+	require.Nil(err)
+	assert.Equal("Z1", writer.(*route53Records).hostedZoneId)
+
+	assert.False(SupportsRecords("digitalocean"))
+	_, err = NewRecordWriter("digitalocean", Env{})
+	assert.True(errors.Is(err, ErrRecordsUnsupported))
+}
@@ -0,0 +1,176 @@
+package dns_provider
+
+import (
+	"fmt"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/miekg/dns"
+	"strings"
+	"sync"
+	"time"
+)
+
+const challengeLabel = "_acme-challenge."
+
+// challengeTTL is the TTL of the challenge records written with a RecordWriter.
+const challengeTTL = 120
+
+// ChallengeDomain is how the challenge of a domain is written.
+type ChallengeDomain struct {
+	Provider challenge.Provider
+	// Records writes the challenge when it is delegated to a name the provider can not write, e.g. of acme-dns. Optional.
+	Records RecordWriter
+	// Alias is the domain the challenge is delegated to with a CNAME, and written as _acme-challenge.<alias>.
+	// Existing CNAMEs are followed when empty.
+	Alias string
+}
+
+// domainProviders dispatches the challenge of each domain to its provider,
+// so that one certificate can cover zones hosted at several providers.
+type domainProviders struct {
+	// domains is keyed by the domain without the wildcard label, as lego presents the challenges
+	domains map[string]*ChallengeDomain
+	// resolver follows the CNAMEs of the challenges, nil to write them at their names
+	resolver *Resolver
+
+	mu sync.Mutex
+	// values are the TXT values written with the record writers, keyed by the name
+	values map[string][]string
+}
+
+// NewDomainProviders creates the provider writing the challenge of each domain with its provider.
+// The keys are the domains of the certificate, and wildcard domains are matched with their base domain.
+func NewDomainProviders(domains map[string]*ChallengeDomain, resolver *Resolver) challenge.Provider {
+	d := &domainProviders{
+		domains:  map[string]*ChallengeDomain{},
+		resolver: resolver,
+		values:   map[string][]string{},
+	}
+	var interval time.Duration
+	isSequential := false
+	for domain, cd := range domains {
+		d.domains[strings.TrimPrefix(strings.ToLower(domain), "*.")] = cd
+		if s, ok := cd.Provider.(sequential); ok {
+			isSequential = true
+			if s.Sequential() > interval {
+				interval = s.Sequential()
+			}
+		}
+	}
+	if isSequential {
+		return &sequentialDomainProviders{domainProviders: d, interval: interval}
+	}
+	return d
+}
+
+// target returns how the challenge of the domain is written, and the name it is written at.
+func (d *domainProviders) target(domain string) (*ChallengeDomain, string, error) {
+	cd, ok := d.domains[strings.TrimPrefix(strings.ToLower(domain), "*.")]
+	if !ok {
+		return nil, "", fmt.Errorf("no dns provider for the domain '%s'", domain)
+	}
+	if cd.Alias != "" {
+		return cd, ChallengeName(cd.Alias), nil
+	}
+	name := ChallengeName(domain)
+	if d.resolver == nil {
+		return cd, name, nil
+	}
+	target, err := d.resolver.ResolveCNAME(name)
+	if err != nil {
+		return nil, "", fmt.Errorf("error on lookup cname of %s %w", name, err)
+	}
+	return cd, target, nil
+}
+
+func (d *domainProviders) Present(domain, token, keyAuth string) error {
+	cd, target, err := d.target(domain)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(target, challengeLabel) {
+		return cd.Provider.Present(strings.TrimSuffix(strings.TrimPrefix(target, challengeLabel), "."), token, keyAuth)
+	}
+	if cd.Records == nil {
+		return fmt.Errorf("the challenge of %s is delegated to %s, which the provider can not write", domain, target)
+	}
+	_, value := dns01.GetRecord(domain, keyAuth)
+	return d.writeValue(cd.Records, target, value, true)
+}
+
+func (d *domainProviders) CleanUp(domain, token, keyAuth string) error {
+	cd, target, err := d.target(domain)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(target, challengeLabel) {
+		return cd.Provider.CleanUp(strings.TrimSuffix(strings.TrimPrefix(target, challengeLabel), "."), token, keyAuth)
+	}
+	if cd.Records == nil {
+		return nil
+	}
+	_, value := dns01.GetRecord(domain, keyAuth)
+	return d.writeValue(cd.Records, target, value, false)
+}
+
+// writeValue adds or removes the value of the TXT records at the name.
+// The values are kept, because a domain and its wildcard write their challenges at the same name.
+func (d *domainProviders) writeValue(writer RecordWriter, name, value string, add bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var values []string
+	for _, v := range d.values[name] {
+		if v != value {
+			values = append(values, v)
+		}
+	}
+	if add {
+		values = append(values, value)
+	}
+	var rrs []dns.RR
+	for _, v := range values {
+		rrs = append(rrs, &dns.TXT{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: challengeTTL},
+			Txt: []string{v},
+		})
+	}
+	err := writer.ReplaceRecords(name, dns.TypeTXT, rrs)
+	if err != nil {
+		return err
+	}
+	d.values[name] = values
+	return nil
+}
+
+// Timeout returns the longest timeout and interval of the providers, because lego uses one for every domain.
+func (d *domainProviders) Timeout() (timeout, interval time.Duration) {
+	for _, cd := range d.domains {
+		t, i := dns01.DefaultPropagationTimeout, dns01.DefaultPollingInterval
+		if p, ok := cd.Provider.(challenge.ProviderTimeout); ok {
+			t, i = p.Timeout()
+		}
+		if t > timeout {
+			timeout = t
+		}
+		if i > interval {
+			interval = i
+		}
+	}
+	return timeout, interval
+}
+
+// sequentialDomainProviders solves the challenges one by one, when one of the providers requires it.
+type sequentialDomainProviders struct {
+	*domainProviders
+	interval time.Duration
+}
+
+func (s *sequentialDomainProviders) Sequential() time.Duration {
+	return s.interval
+}
+
+// ChallengeName returns the name of the challenge record of the domain, e.g. "_acme-challenge.example.com.".
+func ChallengeName(domain string) string {
+	return challengeLabel + dns.Fqdn(strings.TrimPrefix(strings.ToLower(domain), "*."))
+}
@@ -0,0 +1,115 @@
+package dns_provider
+
+import (
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/kamijin-fanta/envoy-acme/pkg/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+type fakeProvider struct {
+	presented []string
+	timeout   time.Duration
+}
+
+func (f *fakeProvider) Present(domain, token, keyAuth string) error {
+	f.presented = append(f.presented, domain)
+	return nil
+}
+
+func (f *fakeProvider) CleanUp(domain, token, keyAuth string) error {
+	return nil
+}
+
+func (f *fakeProvider) Timeout() (timeout, interval time.Duration) {
+	return f.timeout, time.Second
+}
+
+func TestDomainProviders(t *testing.T) {
+	assert := assert.New(t)
+
+	com := &ChallengeDomain{Provider: &fakeProvider{timeout: time.Minute}}
+	net := &ChallengeDomain{Provider: &fakeProvider{timeout: 5 * time.Minute}}
+	provider := NewDomainProviders(map[string]*ChallengeDomain{
+		"example.com":   com,
+		"*.example.com": com,
+		"example.net":   net,
+	}, nil)
+
+	assert.Nil(provider.Present("example.com", "token", "key"))
+	assert.Nil(provider.Present("EXAMPLE.NET", "token", "key"))
+	assert.Error(provider.Present("example.org", "token", "key"))
+	assert.Equal([]string{"example.com"}, com.Provider.(*fakeProvider).presented)
+	assert.Equal([]string{"example.net"}, net.Provider.(*fakeProvider).presented)
+
+	timeout, _ := provider.(challenge.ProviderTimeout).Timeout()
+	assert.Equal(5*time.Minute, timeout)
+}
+
+func TestDomainProvidersDelegation(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	resolver, err := NewResolver([]string{dnstest.StartZoneServer(t,
+		`_acme-challenge.example.com. 60 IN CNAME _acme-challenge.validation.example.net.`,
+		`_acme-challenge.example.org. 60 IN CNAME 0a1b2c.auth.acme-dns.example.`,
+	)})
+	require.Nil(err)
+
+	fake := &fakeProvider{}
+	records := &nameRecordWriter{}
+	provider := NewDomainProviders(map[string]*ChallengeDomain{
+		"example.com":     {Provider: fake},
+		"*.example.com":   {Provider: fake},
+		"www.example.com": {Provider: fake, Alias: "alias.example.net"},
+		"example.org":     {Provider: fake, Records: records},
+		"example.io":      {Provider: fake},
+	}, resolver)
+
+	assert.Nil(provider.Present("example.com", "token", "key"))
+	assert.Nil(provider.Present("www.example.com", "token", "key"))
+	assert.Nil(provider.Present("example.io", "token", "key"))
+	assert.Equal([]string{"validation.example.net", "alias.example.net", "example.io"}, fake.presented)
+
+	// names the provider can not write are written with the record writer
+	assert.Nil(provider.Present("example.org", "token", "key1"))
+	assert.Nil(provider.Present("example.org", "token", "key2"))
+	assert.Len(records.rrsets["0a1b2c.auth.acme-dns.example."], 2)
+	assert.Nil(provider.CleanUp("example.org", "token", "key1"))
+	assert.Len(records.rrsets["0a1b2c.auth.acme-dns.example."], 1)
+}
+
+type nameRecordWriter struct {
+	names  []string
+	rrsets map[string][]dns.RR
+}
+
+func (n *nameRecordWriter) ReplaceRecords(fqdn string, rrtype uint16, rrs []dns.RR) error {
+	n.names = append(n.names, fqdn)
+	if n.rrsets == nil {
+		n.rrsets = map[string][]dns.RR{}
+	}
+	n.rrsets[fqdn] = rrs
+	return nil
+}
+
+func TestDomainRecordWriters(t *testing.T) {
+	assert := assert.New(t)
+
+	com := &nameRecordWriter{}
+	www := &nameRecordWriter{}
+	writer := NewDomainRecordWriters(map[string]RecordWriter{
+		"example.com":     com,
+		"www.example.com": www,
+	})
+
+	assert.Nil(writer.ReplaceRecords("_443._tcp.example.com.", dns.TypeTLSA, nil))
+	assert.Nil(writer.ReplaceRecords("_443._tcp.www.example.com.", dns.TypeTLSA, nil))
+	assert.Nil(writer.ReplaceRecords("_443._tcp.api.example.com.", dns.TypeTLSA, nil))
+	assert.Error(writer.ReplaceRecords("_443._tcp.badexample.com.", dns.TypeTLSA, nil))
+	assert.Equal([]string{"_443._tcp.example.com.", "_443._tcp.api.example.com."}, com.names)
+	assert.Equal([]string{"_443._tcp.www.example.com."}, www.names)
+}
@@ -0,0 +1,120 @@
+package dns_provider
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Env is the provider settings of a site, named like the environment variables of lego.
+type Env map[string]string
+
+// ParseEnv parses the "KEY=VALUE" list of the legoenv setting.
+func ParseEnv(list []string) (Env, error) {
+	env := Env{}
+	for _, item := range list {
+		vars := strings.SplitN(item, "=", 2)
+		if len(vars) != 2 || vars[0] == "" {
+			return nil, fmt.Errorf("invalid variable '%s', must be KEY=VALUE", item)
+		}
+		env[vars[0]] = vars[1]
+	}
+	return env, nil
+}
+
+// credentialKeys are the settings of the providers which can be read from a file with KEY_FILE.
+// Other keys ending with _FILE, e.g. GCE_SERVICE_ACCOUNT_FILE, are settings of their own and kept as they are.
+var credentialKeys = map[string]bool{
+	"AWS_ACCESS_KEY_ID":               true,
+	"AWS_SECRET_ACCESS_KEY":           true,
+	"AWS_SESSION_TOKEN":               true,
+	"CF_API_EMAIL":                    true,
+	"CF_API_KEY":                      true,
+	"CF_DNS_API_TOKEN":                true,
+	"CF_ZONE_API_TOKEN":               true,
+	"CLOUDFLARE_API_KEY":              true,
+	"CLOUDFLARE_DNS_API_TOKEN":        true,
+	"CLOUDFLARE_EMAIL":                true,
+	"CLOUDFLARE_ZONE_API_TOKEN":       true,
+	"DO_AUTH_TOKEN":                   true,
+	"HTTPREQ_PASSWORD":                true,
+	"HTTPREQ_USERNAME":                true,
+	"RFC2136_TSIG_KEY":                true,
+	"RFC2136_TSIG_SECRET":             true,
+	"SAKURACLOUD_ACCESS_TOKEN":        true,
+	"SAKURACLOUD_ACCESS_TOKEN_SECRET": true,
+}
+
+// ReadFiles returns the settings with the content of the file named by KEY_FILE as the value of KEY,
+// for the credentials in credentialKeys unless KEY is also set.
+// A file which can not be read is an error, so that a wrong path never becomes an empty credential.
+func (e Env) ReadFiles() (Env, error) {
+	env := Env{}
+	for key, value := range e {
+		env[key] = value
+	}
+	for key, fileName := range e {
+		name := strings.TrimSuffix(key, "_FILE")
+		if name == key || !credentialKeys[name] {
+			continue
+		}
+		if _, ok := e[name]; ok {
+			continue
+		}
+		content, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("can not read %s %w", key, err)
+		}
+		env[name] = strings.TrimSpace(string(content))
+	}
+	return env, nil
+}
+
+// Get returns the values of the keys, or an error if some of them are missing.
+func (e Env) Get(keys ...string) (map[string]string, error) {
+	values := map[string]string{}
+	var missing []string
+	for _, key := range keys {
+		value := e.Value(key)
+		if value == "" {
+			missing = append(missing, key)
+		}
+		values[key] = value
+	}
+	if len(missing) != 0 {
+		return nil, fmt.Errorf("some credentials information are missing: %s", strings.Join(missing, ","))
+	}
+	return values, nil
+}
+
+// Value returns the value of the key. The files of KEY_FILE are read by ReadFiles beforehand.
+func (e Env) Value(key string) string {
+	return e[key]
+}
+
+func (e Env) GetOrDefaultString(key string, defaultValue string) string {
+	value := e.Value(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+func (e Env) GetOrDefaultInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(e.Value(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// GetOrDefaultSecond returns the value of the key as seconds.
+func (e Env) GetOrDefaultSecond(key string, defaultValue time.Duration) time.Duration {
+	value := e.GetOrDefaultInt(key, -1)
+	if value < 0 {
+		return defaultValue
+	}
+	return time.Duration(value) * time.Second
+}
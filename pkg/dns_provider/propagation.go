@@ -0,0 +1,144 @@
+package dns_provider
+
+import (
+	"fmt"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"time"
+)
+
+// PropagationCheck checks that the TXT record of the challenge is served, with the resolvers of a site.
+// It replaces the precheck of lego, whose resolvers are shared by every site of the process.
+type PropagationCheck struct {
+	*Resolver
+	// Authoritative requires the record on every authoritative nameserver of the zone,
+	// otherwise the record is looked up on the recursive resolvers.
+	Authoritative bool
+}
+
+func NewPropagationCheck(nameservers []string, authoritative bool) (*PropagationCheck, error) {
+	resolver, err := NewResolver(nameservers)
+	if err != nil {
+		return nil, err
+	}
+	return &PropagationCheck{
+		Resolver:      resolver,
+		Authoritative: authoritative,
+	}, nil
+}
+
+// Check reports whether the record of fqdn has the value. It has the signature of dns01.PreCheckFunc.
+func (p *PropagationCheck) Check(fqdn, value string) (bool, error) {
+	reply, err := p.Exchange(fqdn, dns.TypeTXT, p.Nameservers, true)
+	if err != nil {
+		return false, err
+	}
+	if !p.Authoritative {
+		if !hasTXT(reply, value) {
+			return false, fmt.Errorf("txt record of %s is not found on the recursive nameservers", fqdn)
+		}
+		return true, nil
+	}
+
+	// the record is written on the target of the CNAME
+	for _, rr := range reply.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, fqdn) {
+			fqdn = cname.Target
+		}
+	}
+	authoritative, err := p.authoritativeNameservers(fqdn)
+	if err != nil {
+		return false, err
+	}
+	for _, ns := range authoritative {
+		reply, err := p.Exchange(fqdn, dns.TypeTXT, []string{ns}, false)
+		if err != nil {
+			return false, err
+		}
+		if !hasTXT(reply, value) {
+			return false, fmt.Errorf("txt record of %s is not found on the authoritative nameserver %s", fqdn, ns)
+		}
+	}
+	return true, nil
+}
+
+// authoritativeNameservers looks up the nameservers of the zone of fqdn with the recursive resolvers.
+func (p *PropagationCheck) authoritativeNameservers(fqdn string) ([]string, error) {
+	zone, err := dns01.FindZoneByFqdnCustom(fqdn, p.Nameservers)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := p.Exchange(zone, dns.TypeNS, p.Nameservers, true)
+	if err != nil {
+		return nil, err
+	}
+	var nameservers []string
+	for _, rr := range reply.Answer {
+		if ns, ok := rr.(*dns.NS); ok {
+			nameservers = append(nameservers, net.JoinHostPort(strings.TrimSuffix(strings.ToLower(ns.Ns), "."), "53"))
+		}
+	}
+	if len(nameservers) == 0 {
+		return nil, fmt.Errorf("no authoritative nameserver of %s", zone)
+	}
+	return nameservers, nil
+}
+
+func hasTXT(reply *dns.Msg, value string) bool {
+	for _, rr := range reply.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+			return true
+		}
+	}
+	return false
+}
+
+// WithTimeout overrides the propagation timeout and the polling interval of the provider.
+// The values of the provider, or the defaults of lego, are kept for those of 0.
+func WithTimeout(provider challenge.Provider, timeout, interval time.Duration) challenge.Provider {
+	if timeout == 0 && interval == 0 {
+		return provider
+	}
+	t, i := dns01.DefaultPropagationTimeout, dns01.DefaultPollingInterval
+	if p, ok := provider.(challenge.ProviderTimeout); ok {
+		t, i = p.Timeout()
+	}
+	if timeout != 0 {
+		t = timeout
+	}
+	if interval != 0 {
+		i = interval
+	}
+	wrapped := &timeoutProvider{Provider: provider, timeout: t, interval: i}
+	if s, ok := provider.(sequential); ok {
+		return &sequentialTimeoutProvider{timeoutProvider: wrapped, sequential: s}
+	}
+	return wrapped
+}
+
+type sequential interface {
+	Sequential() time.Duration
+}
+
+type timeoutProvider struct {
+	challenge.Provider
+	timeout  time.Duration
+	interval time.Duration
+}
+
+func (t *timeoutProvider) Timeout() (timeout, interval time.Duration) {
+	return t.timeout, t.interval
+}
+
+// sequentialTimeoutProvider keeps the providers which solve the challenges one by one, e.g. rfc2136.
+type sequentialTimeoutProvider struct {
+	*timeoutProvider
+	sequential sequential
+}
+
+func (s *sequentialTimeoutProvider) Sequential() time.Duration {
+	return s.sequential.Sequential()
+}
@@ -0,0 +1,52 @@
+package dns_provider
+
+import (
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/kamijin-fanta/envoy-acme/pkg/dnstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestPropagationCheck(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	resolver := dnstest.StartZoneServer(t, `_acme-challenge.example.com. 60 IN TXT "token"`)
+	checker, err := NewPropagationCheck([]string{resolver}, false)
+	require.Nil(err)
+
+	ok, err := checker.Check("_acme-challenge.example.com.", "token")
+	assert.Nil(err)
+	assert.True(ok)
+
+	ok, err = checker.Check("_acme-challenge.example.com.", "old-token")
+	assert.Error(err)
+	assert.False(ok)
+	ok, err = checker.Check("_acme-challenge.example.net.", "token")
+	assert.Error(err)
+	assert.False(ok)
+}
+
+func TestWithTimeout(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	provider, err := NewDNSProvider("rfc2136", Env{
+		"RFC2136_NAMESERVER":          "127.0.0.1:53",
+		"RFC2136_PROPAGATION_TIMEOUT": "300",
+		"RFC2136_POLLING_INTERVAL":    "5",
+	})
+	require.Nil(err)
+
+	assert.Equal(provider, WithTimeout(provider, 0, 0))
+
+	wrapped := WithTimeout(provider, 0, 10*time.Second)
+	timeout, interval := wrapped.(challenge.ProviderTimeout).Timeout()
+	assert.Equal(300*time.Second, timeout)
+	assert.Equal(10*time.Second, interval)
+	// rfc2136 still solves the challenges one by one
+	_, ok := wrapped.(sequential)
+	assert.True(ok)
+}
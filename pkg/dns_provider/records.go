@@ -0,0 +1,144 @@
+package dns_provider
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RecordWriter writes any type of records, beyond the TXT records of the ACME challenge which lego providers can write.
+type RecordWriter interface {
+	// ReplaceRecords replaces the records of the name and type with rrs. The records are deleted when rrs is empty.
+	ReplaceRecords(fqdn string, rrtype uint16, rrs []dns.RR) error
+}
+
+// recordFactories are the providers which can write records other than the challenge.
+var recordFactories = map[string]func(env Env) (RecordWriter, error){
+	"cloudflare": newCloudflareRecords,
+	"rfc2136":    newRfc2136Records,
+	"route53":    newRoute53Records,
+}
+
+var ErrRecordsUnsupported = errors.New("dns provider can not write records")
+
+// RecordProviders returns the names of the providers which can write records.
+func RecordProviders() []string {
+	names := make([]string, 0, len(recordFactories))
+	for name := range recordFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func SupportsRecords(name string) bool {
+	_, ok := recordFactories[name]
+	return ok
+}
+
+// NewRecordWriter creates the record writer with the settings of a site.
+func NewRecordWriter(name string, env Env) (RecordWriter, error) {
+	factory, ok := recordFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("%w '%s'", ErrRecordsUnsupported, name)
+	}
+	env, err := env.ReadFiles()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	writer, err := factory(env)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return writer, nil
+}
+
+// rfc2136Records writes records with dynamic updates, with the same settings as the rfc2136 provider.
+type rfc2136Records struct {
+	nameserver    string
+	tsigAlgorithm string
+	tsigKey       string
+	tsigSecret    string
+	timeout       time.Duration
+}
+
+func newRfc2136Records(env Env) (RecordWriter, error) {
+	values, err := env.Get("RFC2136_NAMESERVER")
+	if err != nil {
+		return nil, err
+	}
+	nameserver := values["RFC2136_NAMESERVER"]
+	if _, _, err := net.SplitHostPort(nameserver); err != nil {
+		nameserver = net.JoinHostPort(nameserver, "53")
+	}
+	return &rfc2136Records{
+		nameserver:    nameserver,
+		tsigAlgorithm: env.GetOrDefaultString("RFC2136_TSIG_ALGORITHM", dns.HmacMD5),
+		tsigKey:       env.Value("RFC2136_TSIG_KEY"),
+		tsigSecret:    env.Value("RFC2136_TSIG_SECRET"),
+		timeout:       env.GetOrDefaultSecond("RFC2136_DNS_TIMEOUT", 10*time.Second),
+	}, nil
+}
+
+func (r *rfc2136Records) ReplaceRecords(fqdn string, rrtype uint16, rrs []dns.RR) error {
+	zone, err := dns01.FindZoneByFqdn(fqdn)
+	if err != nil {
+		return err
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	m.RemoveRRset([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: fqdn, Rrtype: rrtype, Class: dns.ClassINET}}})
+	if len(rrs) != 0 {
+		m.Insert(rrs)
+	}
+
+	c := &dns.Client{Timeout: r.timeout}
+	if r.tsigKey != "" && r.tsigSecret != "" {
+		m.SetTsig(dns.Fqdn(r.tsigKey), dns.Fqdn(r.tsigAlgorithm), 300, time.Now().Unix())
+		c.TsigSecret = map[string]string{dns.Fqdn(r.tsigKey): r.tsigSecret}
+	}
+	reply, _, err := c.Exchange(m, r.nameserver)
+	if err != nil {
+		return fmt.Errorf("dns update failed %w", err)
+	}
+	if reply != nil && reply.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("dns update failed: %s", dns.RcodeToString[reply.Rcode])
+	}
+	return nil
+}
+
+// domainRecordWriters dispatches the records to the writer of the closest domain, like domainProviders.
+type domainRecordWriters struct {
+	writers map[string]RecordWriter
+}
+
+// NewDomainRecordWriters creates the writer writing each record with the writer of the longest domain matching its name.
+func NewDomainRecordWriters(writers map[string]RecordWriter) RecordWriter {
+	d := &domainRecordWriters{writers: map[string]RecordWriter{}}
+	for domain, writer := range writers {
+		d.writers[dns.Fqdn(strings.TrimPrefix(strings.ToLower(domain), "*."))] = writer
+	}
+	return d
+}
+
+func (d *domainRecordWriters) ReplaceRecords(fqdn string, rrtype uint16, rrs []dns.RR) error {
+	name := strings.ToLower(dns.Fqdn(fqdn))
+	var writer RecordWriter
+	matched := ""
+	for domain, w := range d.writers {
+		if (name == domain || strings.HasSuffix(name, "."+domain)) && len(domain) > len(matched) {
+			writer = w
+			matched = domain
+		}
+	}
+	if writer == nil {
+		return fmt.Errorf("no dns provider for the record '%s'", fqdn)
+	}
+	return writer.ReplaceRecords(fqdn, rrtype, rrs)
+}
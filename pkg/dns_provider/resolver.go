@@ -0,0 +1,88 @@
+package dns_provider
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/miekg/dns"
+	"strings"
+	"time"
+)
+
+// maxCNAMEs limits the length of a CNAME chain followed by ResolveCNAME.
+const maxCNAMEs = 8
+
+// Resolver looks up records with the recursive resolvers of a site.
+type Resolver struct {
+	// Nameservers are the recursive resolvers. The resolvers of /etc/resolv.conf are used when empty.
+	Nameservers []string
+
+	client *dns.Client
+}
+
+func NewResolver(nameservers []string) (*Resolver, error) {
+	if len(nameservers) == 0 {
+		config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, fmt.Errorf("error read resolv.conf %w", err)
+		}
+		if len(config.Servers) == 0 {
+			return nil, errors.New("no nameserver in resolv.conf")
+		}
+		nameservers = config.Servers
+	}
+	return &Resolver{
+		Nameservers: dns01.ParseNameservers(nameservers),
+		client:      &dns.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// ResolveCNAME follows the CNAMEs of the name, and returns the name at the end of the chain.
+// The name itself is returned when it has no CNAME.
+func (r *Resolver) ResolveCNAME(name string) (string, error) {
+	name = dns.Fqdn(name)
+	for i := 0; i < maxCNAMEs; i++ {
+		reply, err := r.Exchange(name, dns.TypeCNAME, r.Nameservers, true)
+		if err != nil {
+			return "", err
+		}
+		target := ""
+		for _, rr := range reply.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				target = cname.Target
+			}
+		}
+		if target == "" {
+			return name, nil
+		}
+		name = strings.ToLower(target)
+	}
+	return "", fmt.Errorf("too many cnames from %s", name)
+}
+
+// Exchange sends the query to the nameservers in order, until one of them replies.
+func (r *Resolver) Exchange(name string, rrtype uint16, nameservers []string, recursive bool) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), rrtype)
+	m.SetEdns0(4096, false)
+	m.RecursionDesired = recursive
+
+	var err error
+	for _, ns := range nameservers {
+		var reply *dns.Msg
+		reply, _, err = r.client.Exchange(m, ns)
+		if err == nil && reply.Truncated {
+			tcp := &dns.Client{Net: "tcp", Timeout: r.client.Timeout}
+			reply, _, err = tcp.Exchange(m, ns)
+		}
+		if err != nil {
+			continue
+		}
+		if reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("lookup of %s on %s failed: %s", name, ns, dns.RcodeToString[reply.Rcode])
+			continue
+		}
+		return reply, nil
+	}
+	return nil, fmt.Errorf("lookup of %s failed %w", name, err)
+}
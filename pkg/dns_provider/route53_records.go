@@ -0,0 +1,101 @@
+package dns_provider
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	awsroute53 "github.com/aws/aws-sdk-go/service/route53"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// route53Records writes records with the api of route53, with the same settings as the route53 provider.
+type route53Records struct {
+	client       *awsroute53.Route53
+	hostedZoneId string
+	findZone     func(fqdn string) (string, error)
+}
+
+func newRoute53Records(env Env) (RecordWriter, error) {
+	client, err := newRoute53Client(env)
+	if err != nil {
+		return nil, err
+	}
+	return &route53Records{
+		client:       client,
+		hostedZoneId: env.Value("AWS_HOSTED_ZONE_ID"),
+		findZone:     dns01.FindZoneByFqdn,
+	}, nil
+}
+
+// ReplaceRecords upserts the record set, which route53 applies atomically.
+func (r *route53Records) ReplaceRecords(fqdn string, rrtype uint16, rrs []dns.RR) error {
+	zoneId, err := r.zoneId(fqdn)
+	if err != nil {
+		return err
+	}
+	name := strings.ToLower(dns.Fqdn(fqdn))
+	rrset := &awsroute53.ResourceRecordSet{
+		Name: aws.String(name),
+		Type: aws.String(dns.TypeToString[rrtype]),
+	}
+	action := awsroute53.ChangeActionUpsert
+	if len(rrs) == 0 {
+		// deleting requires the current record set
+		output, err := r.client.ListResourceRecordSets(&awsroute53.ListResourceRecordSetsInput{
+			HostedZoneId:    aws.String(zoneId),
+			StartRecordName: aws.String(name),
+			StartRecordType: aws.String(dns.TypeToString[rrtype]),
+			MaxItems:        aws.String("1"),
+		})
+		if err != nil {
+			return fmt.Errorf("route53: list records %w", err)
+		}
+		if len(output.ResourceRecordSets) == 0 || !strings.EqualFold(aws.StringValue(output.ResourceRecordSets[0].Name), name) ||
+			aws.StringValue(output.ResourceRecordSets[0].Type) != dns.TypeToString[rrtype] {
+			return nil
+		}
+		rrset = output.ResourceRecordSets[0]
+		action = awsroute53.ChangeActionDelete
+	} else {
+		rrset.TTL = aws.Int64(int64(rrs[0].Header().Ttl))
+		for _, rr := range rrs {
+			rrset.ResourceRecords = append(rrset.ResourceRecords, &awsroute53.ResourceRecord{Value: aws.String(rdata(rr))})
+		}
+	}
+
+	_, err = r.client.ChangeResourceRecordSets(&awsroute53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(zoneId),
+		ChangeBatch: &awsroute53.ChangeBatch{
+			Comment: aws.String("Managed by envoy-acme"),
+			Changes: []*awsroute53.Change{{Action: aws.String(action), ResourceRecordSet: rrset}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("route53: change records %w", err)
+	}
+	return nil
+}
+
+// zoneId returns AWS_HOSTED_ZONE_ID, or the public hosted zone of the zone of the name like the route53 provider.
+func (r *route53Records) zoneId(fqdn string) (string, error) {
+	if r.hostedZoneId != "" {
+		return r.hostedZoneId, nil
+	}
+	zone, err := r.findZone(fqdn)
+	if err != nil {
+		return "", err
+	}
+	output, err := r.client.ListHostedZonesByName(&awsroute53.ListHostedZonesByNameInput{
+		DNSName: aws.String(dns01.UnFqdn(zone)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("route53: list hosted zones %w", err)
+	}
+	for _, hostedZone := range output.HostedZones {
+		if strings.EqualFold(aws.StringValue(hostedZone.Name), zone) && (hostedZone.Config == nil || !aws.BoolValue(hostedZone.Config.PrivateZone)) {
+			return strings.TrimPrefix(aws.StringValue(hostedZone.Id), "/hostedzone/"), nil
+		}
+	}
+	return "", fmt.Errorf("route53: no public hosted zone of %s", zone)
+}
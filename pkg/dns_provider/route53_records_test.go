@@ -0,0 +1,56 @@
+package dns_provider
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoute53Records(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var changes []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/2013-04-01/hostedzone/Z1/rrset/":
+			body, _ := ioutil.ReadAll(r.Body)
+			changes = append(changes, string(body))
+			w.Write([]byte(`<ChangeResourceRecordSetsResponse><ChangeInfo><Id>/change/C1</Id><Status>PENDING</Status></ChangeInfo></ChangeResourceRecordSetsResponse>`))
+		case r.Method == http.MethodGet && r.URL.Path == "/2013-04-01/hostedzone/Z1/rrset":
+			w.Write([]byte(`<ListResourceRecordSetsResponse><ResourceRecordSets><ResourceRecordSet>
+<Name>_443._tcp.example.com.</Name><Type>TLSA</Type><TTL>300</TTL>
+<ResourceRecords><ResourceRecord><Value>3 1 1 aaaa</Value></ResourceRecord></ResourceRecords>
+</ResourceRecordSet></ResourceRecordSets><IsTruncated>false</IsTruncated><MaxItems>1</MaxItems></ListResourceRecordSetsResponse>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	writer, err := newRoute53Records(Env{"AWS_HOSTED_ZONE_ID": "Z1", "AWS_ACCESS_KEY_ID": "key", "AWS_SECRET_ACCESS_KEY": "secret"})
+	require.Nil(err)
+	writer.(*route53Records).client.Endpoint = server.URL
+
+	rr, err := dns.NewRR("_443._tcp.example.com. 300 IN TLSA 3 1 1 aaaa")
+	require.Nil(err)
+	require.Nil(writer.ReplaceRecords("_443._tcp.example.com.", dns.TypeTLSA, []dns.RR{rr}))
+	require.Len(changes, 1)
+	assert.Contains(changes[0], "<Action>UPSERT</Action>")
+	assert.Contains(changes[0], "<Value>3 1 1 aaaa</Value>")
+	assert.Contains(changes[0], "<TTL>300</TTL>")
+
+	// deleting sends the current record set
+	require.Nil(writer.ReplaceRecords("_443._tcp.example.com.", dns.TypeTLSA, nil))
+	require.Len(changes, 2)
+	assert.Contains(changes[1], "<Action>DELETE</Action>")
+	assert.Contains(changes[1], "<Value>3 1 1 aaaa</Value>")
+
+	// nothing to delete
+	require.Nil(writer.ReplaceRecords("_25._tcp.example.com.", dns.TypeTLSA, nil))
+	assert.Len(changes, 2)
+}
@@ -0,0 +1,42 @@
+// Package dnstest provides a DNS server for the tests of the packages resolving records.
+package dnstest
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+// StartZoneServer serves the records on a local udp port, and returns its address.
+// The records are in the zone file format, e.g. `example.com. 300 IN CAA 0 issue "letsencrypt.org"`.
+// CNAMEs are answered for every type, but not followed. The server is shut down when the test ends.
+func StartZoneServer(t *testing.T, records ...string) string {
+	var zone []dns.RR
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		require.Nil(t, err)
+		zone = append(zone, rr)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			q := r.Question[0]
+			for _, rr := range zone {
+				if rr.Header().Name == q.Name && (rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME) {
+					m.Answer = append(m.Answer, rr)
+				}
+			}
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	t.Cleanup(func() {
+		server.Shutdown()
+	})
+	return conn.LocalAddr().String()
+}
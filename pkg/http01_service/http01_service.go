@@ -0,0 +1,118 @@
+package http01_service
+
+import (
+	"errors"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var (
+	http01RequestCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: common.PrometheusNamespace,
+		Name:      "http01_request",
+	}, []string{"result"})
+)
+
+// tokens are base64url encoded, see RFC 8555 section 8.3
+var tokenPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+var _ challenge.Provider = &Provider{}
+
+// Provider presents http-01 challenges by writing them to the store.
+// They are answered by any Http01Service sharing the same store.
+type Provider struct {
+	store store.Store
+}
+
+func NewProvider(store store.Store) *Provider {
+	return &Provider{
+		store: store,
+	}
+}
+
+func (p *Provider) Present(domain, token, keyAuth string) error {
+	return p.store.WriteChallenge(&store.Challenge{
+		Type:    string(challenge.HTTP01),
+		Domain:  domain,
+		Token:   token,
+		KeyAuth: keyAuth,
+	})
+}
+
+func (p *Provider) CleanUp(domain, token, keyAuth string) error {
+	return p.store.DeleteChallenge(string(challenge.HTTP01), token)
+}
+
+var _ http.Handler = &Http01Service{}
+
+type Http01Service struct {
+	store  store.Store
+	logger *logrus.Entry
+}
+
+func NewHttp01Service(store store.Store, logger *logrus.Logger) *Http01Service {
+	return &Http01Service{
+		store:  store,
+		logger: logger.WithField("component", "http01_service"),
+	}
+}
+
+func (h *Http01Service) RunServer(listener net.Listener) error {
+	h.logger.WithField("addr", listener.Addr().String()).Info("start server")
+	return http.Serve(listener, h)
+}
+
+func (h *Http01Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := http01.ChallengePath("")
+	if r.Method != http.MethodGet || !strings.HasPrefix(r.URL.Path, prefix) {
+		http01RequestCounter.WithLabelValues("not_found").Inc()
+		http.NotFound(w, r)
+		return
+	}
+	token := strings.TrimPrefix(r.URL.Path, prefix)
+	requestLogger := h.logger.WithField("host", r.Host).WithField("token", token)
+	if !tokenPattern.MatchString(token) {
+		requestLogger.Debug("invalid token")
+		http01RequestCounter.WithLabelValues("not_found").Inc()
+		http.NotFound(w, r)
+		return
+	}
+
+	chlg, err := h.store.FetchChallenge(string(challenge.HTTP01), token)
+	if errors.Is(err, store.ErrNotFoundChallenge) {
+		requestLogger.Debug("unknown token")
+		http01RequestCounter.WithLabelValues("not_found").Inc()
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		requestLogger.WithError(err).Warn("error on fetch challenge")
+		http01RequestCounter.WithLabelValues("error").Inc()
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !strings.EqualFold(host, chlg.Domain) {
+		requestLogger.WithField("domain", chlg.Domain).Debug("host does not match challenge domain")
+		http01RequestCounter.WithLabelValues("not_found").Inc()
+		http.NotFound(w, r)
+		return
+	}
+
+	requestLogger.Info("serve http-01 challenge")
+	http01RequestCounter.WithLabelValues("success").Inc()
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(chlg.KeyAuth))
+}
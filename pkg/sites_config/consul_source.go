@@ -0,0 +1,194 @@
+package sites_config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ghodss/yaml"
+	"github.com/hashicorp/consul/api"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var _ Source = &ConsulSource{}
+
+const (
+	// consulWaitTime is the longest time a blocking query waits for a change
+	consulWaitTime = 5 * time.Minute
+	// consulRetryInterval is the wait after a failed query
+	consulRetryInterval = 10 * time.Second
+)
+
+// ConsulSource reads the sites config from Consul KV, and watches it with blocking queries.
+// The key holds a whole sites config document, and each key under "<key>/" holds one site.
+// Both can be used together, e.g. the cas in the document and the sites in their own keys.
+type ConsulSource struct {
+	key      string
+	kvClient *api.KV
+	logger   *logrus.Entry
+
+	// index is the raft index of the config last read
+	index uint64
+	stop  chan struct{}
+}
+
+// NewConsulSource creates the source of the key, with the consul agent of the environment like the consul store.
+func NewConsulSource(key string, logger *logrus.Logger) (*ConsulSource, error) {
+	key = strings.Trim(key, "/")
+	if key == "" {
+		return nil, errors.New("consul key of the sites config must not be empty")
+	}
+	client, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &ConsulSource{
+		key:      key,
+		kvClient: client.KV(),
+		logger:   logger.WithField("component", "sites_config").WithField("key", key),
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+func (c *ConsulSource) Load() (*common.SitesConfig, error) {
+	pairs, meta, err := c.kvClient.List(c.key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed read consul kv %w", err)
+	}
+	c.index = meta.LastIndex
+	return parseConsulPairs(c.key, pairs)
+}
+
+// consulResult is the result of a blocking query.
+type consulResult struct {
+	pairs api.KVPairs
+	meta  *api.QueryMeta
+	err   error
+}
+
+// Watch applies the changes of the blocking queries. SIGHUP forces a read of the current config, like FileSource.
+func (c *ConsulSource) Watch(apply func(*common.SitesConfig)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// the query running when the watch is stopped does not block on the result
+	results := make(chan consulResult, 1)
+	query := func(index uint64) {
+		go func() {
+			pairs, meta, err := c.kvClient.List(c.key, &api.QueryOptions{
+				WaitIndex: index,
+				WaitTime:  consulWaitTime,
+			})
+			results <- consulResult{pairs: pairs, meta: meta, err: err}
+		}()
+	}
+	go func() {
+		defer signal.Stop(hup)
+		query(c.index)
+		// retry is set while the query waits for consulRetryInterval after an error
+		var retry <-chan time.Time
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-retry:
+				retry = nil
+				query(c.index)
+			case <-hup:
+				c.logger.Info("reload sites config on SIGHUP")
+				pairs, meta, err := c.kvClient.List(c.key, nil)
+				if err != nil {
+					c.logger.WithError(err).Error("failed read consul kv, keep the current sites config")
+					continue
+				}
+				c.index = meta.LastIndex
+				c.apply(apply, pairs)
+			case result := <-results:
+				switch {
+				case result.err != nil:
+					c.logger.WithError(result.err).Warn("error on watch consul kv")
+					retry = time.After(consulRetryInterval)
+					continue
+				case result.meta.LastIndex == c.index:
+					// timed out without changes, or already read on SIGHUP
+				case result.meta.LastIndex < c.index:
+					// the index went backwards, e.g. the cluster was restored
+					c.index = 0
+				default:
+					c.index = result.meta.LastIndex
+					c.apply(apply, result.pairs)
+				}
+				query(c.index)
+			}
+		}
+	}()
+}
+
+func (c *ConsulSource) Stop() {
+	close(c.stop)
+}
+
+func (c *ConsulSource) apply(apply func(*common.SitesConfig), pairs api.KVPairs) {
+	sitesConfig, err := parseConsulPairs(c.key, pairs)
+	if err != nil {
+		c.logger.WithError(err).Error("keep the current sites config")
+		return
+	}
+	c.logger.WithField("sites", len(sitesConfig.Sites)).Info("sites config changed")
+	apply(sitesConfig)
+}
+
+// parseConsulPairs builds the sites config from the document at the key and the sites under "<key>/".
+// The name of a site defaults to its key under "<key>/". Keys nested deeper are rejected, because the sites
+// of different folders would be named alike. Folders and empty keys are skipped.
+// No keys are an error rather than a config without sites, e.g. the prefix was deleted or the token can not read it,
+// so that the current certificates are kept.
+func parseConsulPairs(key string, pairs api.KVPairs) (*common.SitesConfig, error) {
+	sitesConfig := &common.SitesConfig{}
+	document := false
+	var sitePairs api.KVPairs
+	for _, pair := range pairs {
+		switch {
+		case pair.Key == key:
+			document = true
+			err := yaml.Unmarshal(pair.Value, sitesConfig)
+			if err != nil {
+				return nil, fmt.Errorf("can not parse %s %w", pair.Key, err)
+			}
+		case strings.HasPrefix(pair.Key, key+"/") && !strings.HasSuffix(pair.Key, "/") && len(pair.Value) != 0:
+			if strings.Contains(strings.TrimPrefix(pair.Key, key+"/"), "/") {
+				return nil, fmt.Errorf("nested key %s, sites must be directly under %s/", pair.Key, key)
+			}
+			sitePairs = append(sitePairs, pair)
+		}
+	}
+	if !document && len(sitePairs) == 0 {
+		return nil, fmt.Errorf("no sites config at consul key %s", key)
+	}
+
+	sort.Slice(sitePairs, func(i, j int) bool {
+		return sitePairs[i].Key < sitePairs[j].Key
+	})
+	for _, pair := range sitePairs {
+		site := &common.Site{}
+		err := yaml.Unmarshal(pair.Value, site)
+		if err != nil {
+			return nil, fmt.Errorf("can not parse %s %w", pair.Key, err)
+		}
+		if site.Name == "" {
+			site.Name = strings.TrimPrefix(pair.Key, key+"/")
+		}
+		sitesConfig.Sites = append(sitesConfig.Sites, site)
+	}
+
+	err := sitesConfig.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return sitesConfig, nil
+}
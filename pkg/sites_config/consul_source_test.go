@@ -0,0 +1,116 @@
+package sites_config
+
+import (
+	"encoding/json"
+	"github.com/hashicorp/consul/api"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseConsulPairs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	pairs := api.KVPairs{
+		{Key: "envoy-acme/sites", Value: []byte(`
+cas:
+  - directory: https://acme.zerossl.com/v2/DV90
+    eab_kid: kid
+    eab_hmac: hmac
+sites:
+  - name: document
+    provider: sakuracloud
+    domains: ["example.org"]
+`)},
+		{Key: "envoy-acme/sites/www", Value: []byte(`
+provider: sakuracloud
+domains: ["www.example.com"]
+`)},
+		{Key: "envoy-acme/sites/api", Value: []byte(`
+name: api-site
+provider: sakuracloud
+domains: ["api.example.com"]
+`)},
+		{Key: "envoy-acme/sites/folder/"},
+		{Key: "envoy-acme/sites-other", Value: []byte(`invalid`)},
+	}
+	sitesConfig, err := parseConsulPairs("envoy-acme/sites", pairs)
+	require.Nil(err)
+	require.Len(sitesConfig.CertificateAuthorities, 1)
+	require.Len(sitesConfig.Sites, 3)
+	assert.Equal("document", sitesConfig.Sites[0].Name)
+	assert.Equal("api-site", sitesConfig.Sites[1].Name)
+	assert.Equal("www", sitesConfig.Sites[2].Name)
+
+	// the config is validated as a whole
+	pairs = append(pairs, &api.KVPair{Key: "envoy-acme/sites/document", Value: []byte(`
+provider: sakuracloud
+domains: ["example.net"]
+`)})
+	_, err = parseConsulPairs("envoy-acme/sites", pairs)
+	assert.Error(err)
+
+	// no keys do not remove every site
+	_, err = parseConsulPairs("envoy-acme/sites", nil)
+	assert.Error(err)
+	_, err = parseConsulPairs("envoy-acme/sites", api.KVPairs{{Key: "envoy-acme/sites/folder/"}})
+	assert.Error(err)
+	sitesConfig, err = parseConsulPairs("envoy-acme/sites", api.KVPairs{{Key: "envoy-acme/sites", Value: []byte(`sites: []`)}})
+	require.Nil(err)
+	assert.Empty(sitesConfig.Sites)
+
+	// the sites of different folders would have the same name
+	_, err = parseConsulPairs("envoy-acme/sites", api.KVPairs{{Key: "envoy-acme/sites/staging/www", Value: []byte(`
+provider: sakuracloud
+domains: ["www.example.com"]
+`)}})
+	assert.Error(err)
+}
+
+func TestConsulSourceWatchRetry(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// the blocking queries fail, and the config is read without an index
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("index") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Consul-Index", "2")
+		json.NewEncoder(w).Encode(api.KVPairs{{Key: "envoy-acme/sites", Value: []byte(`sites: []`)}})
+	}))
+	defer server.Close()
+	client, err := api.NewClient(&api.Config{Address: server.URL})
+	require.Nil(err)
+	source := &ConsulSource{
+		key:      "envoy-acme/sites",
+		kvClient: client.KV(),
+		logger:   logrus.NewEntry(logrus.New()),
+		index:    1,
+		stop:     make(chan struct{}),
+	}
+
+	applied := make(chan *common.SitesConfig, 1)
+	source.Watch(func(sitesConfig *common.SitesConfig) {
+		applied <- sitesConfig
+	})
+	defer source.Stop()
+	// SIGHUP is handled while the watch waits to retry the failed query
+	time.Sleep(100 * time.Millisecond)
+	require.Nil(syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	select {
+	case sitesConfig := <-applied:
+		assert.Empty(sitesConfig.Sites)
+	case <-time.After(consulRetryInterval / 2):
+		t.Fatal("sites config is not reloaded on SIGHUP")
+	}
+}
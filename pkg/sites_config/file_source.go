@@ -0,0 +1,103 @@
+package sites_config
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var _ Source = &FileSource{}
+
+// FileSource reads the sites config from a file, and reloads it on SIGHUP and when its content has changed.
+type FileSource struct {
+	path     string
+	interval time.Duration
+	logger   *logrus.Entry
+
+	// current is the content last read, to detect changes
+	current []byte
+	stop    chan struct{}
+}
+
+// NewFileSource creates the source of the file. It is checked for changes every interval, 0 to reload on SIGHUP only.
+func NewFileSource(path string, interval time.Duration, logger *logrus.Logger) *FileSource {
+	return &FileSource{
+		path:     path,
+		interval: interval,
+		logger:   logger.WithField("component", "sites_config").WithField("path", path),
+		stop:     make(chan struct{}),
+	}
+}
+
+func (f *FileSource) Load() (*common.SitesConfig, error) {
+	sitesConfig, _, err := f.reload(true)
+	return sitesConfig, err
+}
+
+func (f *FileSource) Watch(apply func(*common.SitesConfig)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	var ticker *time.Ticker
+	if f.interval > 0 {
+		ticker = time.NewTicker(f.interval)
+		tick = ticker.C
+	}
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			force := false
+			select {
+			case <-hup:
+				f.logger.Info("reload sites config on SIGHUP")
+				force = true
+			case <-tick:
+			case <-f.stop:
+				if ticker != nil {
+					ticker.Stop()
+				}
+				return
+			}
+
+			sitesConfig, changed, err := f.reload(force)
+			if err != nil {
+				f.logger.WithError(err).Error("keep the current sites config")
+				continue
+			}
+			if changed {
+				f.logger.WithField("sites", len(sitesConfig.Sites)).Info("sites config changed")
+				apply(sitesConfig)
+			}
+		}
+	}()
+}
+
+func (f *FileSource) Stop() {
+	close(f.stop)
+}
+
+// reload reads the file, and parses it when its content has changed or force is set.
+// An invalid content is reported once, until it changes again.
+func (f *FileSource) reload(force bool) (*common.SitesConfig, bool, error) {
+	configBytes, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed read config file %w", err)
+	}
+	if !force && bytes.Equal(configBytes, f.current) {
+		return nil, false, nil
+	}
+	f.current = configBytes
+
+	sitesConfig, err := common.ParseSitesConfig(configBytes)
+	if err != nil {
+		return nil, false, fmt.Errorf("can not parse sites config %w", err)
+	}
+	return sitesConfig, true, nil
+}
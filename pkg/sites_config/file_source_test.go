@@ -0,0 +1,64 @@
+package sites_config
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFileSource(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	f, err := ioutil.TempFile("", "sites-*.yaml")
+	require.Nil(err)
+	defer os.Remove(f.Name())
+	f.Close()
+	write := func(content string) {
+		require.Nil(ioutil.WriteFile(f.Name(), []byte(content), 0600))
+	}
+
+	write(`
+sites:
+  - name: www
+    provider: sakuracloud
+    domains: ["www.example.com"]
+`)
+	source := NewFileSource(f.Name(), 0, logrus.New())
+	sitesConfig, err := source.Load()
+	require.Nil(err)
+	assert.Len(sitesConfig.Sites, 1)
+
+	_, changed, err := source.reload(false)
+	assert.Nil(err)
+	assert.False(changed)
+
+	write(`
+sites:
+  - name: www
+    provider: sakuracloud
+    domains: ["www.example.com"]
+  - name: api
+    provider: sakuracloud
+    domains: ["api.example.com"]
+`)
+	sitesConfig, changed, err = source.reload(false)
+	assert.Nil(err)
+	assert.True(changed)
+	assert.Len(sitesConfig.Sites, 2)
+
+	// an invalid config is reported once
+	write(`
+sites:
+  - name: www
+    domains: ["www.example.com"]
+`)
+	_, _, err = source.reload(false)
+	assert.Error(err)
+	_, changed, err = source.reload(false)
+	assert.Nil(err)
+	assert.False(changed)
+}
@@ -0,0 +1,30 @@
+package sites_config
+
+import (
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// Source provides the sites config, from a file or from Consul KV.
+type Source interface {
+	// Load reads and validates the current sites config.
+	Load() (*common.SitesConfig, error)
+	// Watch calls apply with the sites config every time it has changed, after it is validated.
+	// Invalid configs are logged and skipped, so the current config is kept.
+	Watch(apply func(*common.SitesConfig))
+	// Stop ends the watch.
+	Stop()
+}
+
+const consulScheme = "consul://"
+
+// NewSource creates the source of the config argument, "consul://<key>" or a file path.
+// The file is checked for changes every interval.
+func NewSource(config string, interval time.Duration, logger *logrus.Logger) (Source, error) {
+	if strings.HasPrefix(config, consulScheme) {
+		return NewConsulSource(strings.TrimPrefix(config, consulScheme), logger)
+	}
+	return NewFileSource(config, interval, logger), nil
+}
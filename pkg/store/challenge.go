@@ -0,0 +1,14 @@
+package store
+
+import "errors"
+
+var ErrNotFoundChallenge = errors.New("not found challenge")
+
+// Challenge is an ACME challenge that is currently being fulfilled.
+// It is kept in the store so that every instance can answer the validation request.
+type Challenge struct {
+	Type    string `json:"type"`
+	Domain  string `json:"domain"`
+	Token   string `json:"token"`
+	KeyAuth string `json:"key_auth"`
+}
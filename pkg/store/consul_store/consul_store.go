@@ -34,10 +34,22 @@ type ConsulStore struct {
 }
 
 func (c *ConsulStore) FetchUser(caServer string, userId string) (*store.Account, error) {
-	key, err := userKey(c.keyPrefix, caServer, userId)
+	key, err := userKey(c.keyPrefix, caServer, userId, false)
 	if err != nil {
 		return nil, err
 	}
+	return c.readUser(key)
+}
+
+func (c *ConsulStore) FetchLegacyUser(caServer string, userId string) (*store.Account, error) {
+	key, err := userKey(c.keyPrefix, caServer, userId, true)
+	if err != nil {
+		return nil, err
+	}
+	return c.readUser(key)
+}
+
+func (c *ConsulStore) readUser(key string) (*store.Account, error) {
 	res, _, err := c.kvClient.Get(key, nil)
 	if err != nil {
 		return nil, err
@@ -57,7 +69,7 @@ func (c *ConsulStore) FetchUser(caServer string, userId string) (*store.Account,
 }
 
 func (c *ConsulStore) WriteUser(caServer string, account *store.Account) error {
-	key, err := userKey(c.keyPrefix, caServer, account.Email)
+	key, err := userKey(c.keyPrefix, caServer, account.Email, false)
 	if err != nil {
 		return nil
 	}
@@ -113,13 +125,125 @@ func (c *ConsulStore) WriteResource(symbolicDomainName string, resource *store.C
 	return nil
 }
 
+func (c *ConsulStore) FetchChallenge(challengeType string, token string) (*store.Challenge, error) {
+	key := challengeKey(c.keyPrefix, challengeType, token)
+	res, _, err := c.kvClient.Get(key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		// 404 not found
+		return nil, store.ErrNotFoundChallenge
+	}
+
+	challenge := new(store.Challenge)
+	err = json.Unmarshal(res.Value, challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	return challenge, nil
+}
+
+func (c *ConsulStore) ListChallenges(challengeType string) ([]*store.Challenge, error) {
+	prefix := path.Join(c.keyPrefix, "challenge", challengeType) + "/"
+	pairs, _, err := c.kvClient.List(prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	challenges := make([]*store.Challenge, 0, len(pairs))
+	for _, pair := range pairs {
+		challenge := new(store.Challenge)
+		err = json.Unmarshal(pair.Value, challenge)
+		if err != nil {
+			return nil, err
+		}
+		challenges = append(challenges, challenge)
+	}
+
+	return challenges, nil
+}
+
+func (c *ConsulStore) WriteChallenge(challenge *store.Challenge) error {
+	key := challengeKey(c.keyPrefix, challenge.Type, challenge.Token)
+
+	content, err := json.MarshalIndent(challenge, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = c.kvClient.Put(&api.KVPair{
+		Key:   key,
+		Value: content,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *ConsulStore) DeleteChallenge(challengeType string, token string) error {
+	key := challengeKey(c.keyPrefix, challengeType, token)
+	_, err := c.kvClient.Delete(key, nil)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *ConsulStore) FetchFailure(symbolicDomainName string) (*store.FailureState, error) {
+	key := failureKey(c.keyPrefix, symbolicDomainName)
+	res, _, err := c.kvClient.Get(key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		// 404 not found
+		return nil, store.ErrNotFoundFailure
+	}
+
+	failure := new(store.FailureState)
+	err = json.Unmarshal(res.Value, failure)
+	if err != nil {
+		return nil, err
+	}
+
+	return failure, nil
+}
+
+func (c *ConsulStore) WriteFailure(symbolicDomainName string, failure *store.FailureState) error {
+	key := failureKey(c.keyPrefix, symbolicDomainName)
+
+	content, err := json.MarshalIndent(failure, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = c.kvClient.Put(&api.KVPair{
+		Key:   key,
+		Value: content,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *ConsulStore) DeleteFailure(symbolicDomainName string) error {
+	key := failureKey(c.keyPrefix, symbolicDomainName)
+	_, err := c.kvClient.Delete(key, nil)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 type lockObj struct {
 	Id    string
 	Limit time.Time
 }
 
-func (c *ConsulStore) Lock(id string, timeout time.Duration) (bool, error) {
-	key := lockKey(c.keyPrefix)
+func (c *ConsulStore) Lock(name string, id string, timeout time.Duration) (bool, error) {
+	key := lockKey(c.keyPrefix, name)
 	res, meta, err := c.kvClient.Get(key, nil)
 	if err != nil {
 		return false, err
@@ -168,19 +292,24 @@ func (c *ConsulStore) Lock(id string, timeout time.Duration) (bool, error) {
 	}
 }
 
-func (c *ConsulStore) Release(id string) error {
-	key := lockKey(c.keyPrefix)
+func (c *ConsulStore) Release(name string, id string) error {
+	key := lockKey(c.keyPrefix, name)
 
 	res, meta, err := c.kvClient.Get(key, nil)
 	if err != nil {
 		return err
 	}
+	if res == nil {
+		return nil
+	}
 	lock := &lockObj{}
-	if res != nil {
-		err = json.Unmarshal(res.Value, &lock)
-		if err != nil {
-			return err
-		}
+	err = json.Unmarshal(res.Value, &lock)
+	if err != nil {
+		return err
+	}
+	if lock.Id != id {
+		// owned by another instance
+		return nil
 	}
 
 	_, _, err = c.kvClient.DeleteCAS(&api.KVPair{
@@ -194,12 +323,18 @@ func (c *ConsulStore) Release(id string) error {
 	return nil
 }
 
-func userKey(base, caServer, userId string) (string, error) {
+// userKey returns the key of the account of the ca directory, keyed by the host and the path of the directory
+// because a ca can serve several directories with their own accounts. legacy returns the key of the host only.
+func userKey(base, caServer, userId string, legacy bool) (string, error) {
 	serverUrl, err := url.Parse(caServer)
 	if err != nil {
 		return "", err
 	}
-	serverPath := strings.NewReplacer(":", "_", "/", "_").Replace(serverUrl.Host)
+	server := serverUrl.Host
+	if !legacy {
+		server += strings.TrimSuffix(serverUrl.Path, "/")
+	}
+	serverPath := strings.NewReplacer(":", "_", "/", "_").Replace(server)
 
 	return path.Join(base, "user", fmt.Sprintf("%s-%s.json", serverPath, userId)), nil
 }
@@ -208,6 +343,14 @@ func resourceKey(base, domainName string) string {
 	return path.Join(base, "resource", fmt.Sprintf("%s.json", domainName))
 }
 
-func lockKey(base string) string {
-	return path.Join(base, "leader")
+func challengeKey(base, challengeType, token string) string {
+	return path.Join(base, "challenge", challengeType, fmt.Sprintf("%s.json", token))
+}
+
+func failureKey(base, domainName string) string {
+	return path.Join(base, "failure", fmt.Sprintf("%s.json", domainName))
+}
+
+func lockKey(base, name string) string {
+	return path.Join(base, "lock", name)
 }
@@ -60,25 +60,79 @@ func TestConsulStore(t *testing.T) {
 	response, err := consulStore.FetchResource(domain)
 	require.Nil(err)
 	require.NotNil(response)
-	assert.EqualValues(testResource, response.ToCertificateResource())
+	assert.Equal(testResource, response)
+	assert.Equal(testResource.ToCertificateResource(), response.ToCertificateResource())
+
+	testChallenge := &store.Challenge{
+		Type:    "http-01",
+		Domain:  domain,
+		Token:   "token",
+		KeyAuth: "token.thumbprint",
+	}
+	err = consulStore.WriteChallenge(testChallenge)
+	require.Nil(err)
+
+	challenge, err := consulStore.FetchChallenge("http-01", "token")
+	require.Nil(err)
+	assert.Equal(testChallenge, challenge)
+
+	challenges, err := consulStore.ListChallenges("http-01")
+	require.Nil(err)
+	assert.Equal([]*store.Challenge{testChallenge}, challenges)
+	challenges, err = consulStore.ListChallenges("tls-alpn-01")
+	require.Nil(err)
+	assert.Empty(challenges)
+
+	err = consulStore.DeleteChallenge("http-01", "token")
+	require.Nil(err)
+	_, err = consulStore.FetchChallenge("http-01", "token")
+	assert.Equal(store.ErrNotFoundChallenge, err)
+
+	testFailure := &store.FailureState{
+		Count:       2,
+		LastError:   "error",
+		LastAttempt: time.Now().UTC().Truncate(time.Second),
+		NextAttempt: time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+	}
+	err = consulStore.WriteFailure(domain, testFailure)
+	require.Nil(err)
+
+	failure, err := consulStore.FetchFailure(domain)
+	require.Nil(err)
+	assert.Equal(testFailure, failure)
+
+	err = consulStore.DeleteFailure(domain)
+	require.Nil(err)
+	_, err = consulStore.FetchFailure(domain)
+	assert.Equal(store.ErrNotFoundFailure, err)
 
 	lockTimeout := 100 * time.Millisecond
-	res, err := consulStore.Lock("a", lockTimeout)
+	res, err := consulStore.Lock(domain, "a", lockTimeout)
 	require.Nil(err)
 	assert.True(res)
-	res, err = consulStore.Lock("b", lockTimeout)
+	res, err = consulStore.Lock(domain, "b", lockTimeout)
 	require.Nil(err)
 	assert.False(res)
 	time.Sleep(lockTimeout)
-	res, err = consulStore.Lock("b", lockTimeout)
+	res, err = consulStore.Lock(domain, "b", lockTimeout)
 	require.Nil(err)
 	assert.True(res)
-	res, err = consulStore.Lock("a", lockTimeout)
+	res, err = consulStore.Lock(domain, "a", lockTimeout)
 	require.Nil(err)
 	assert.False(res)
-	err = consulStore.Release("b")
+	err = consulStore.Release(domain, "b")
 	require.Nil(err)
-	res, err = consulStore.Lock("a", lockTimeout)
+	res, err = consulStore.Lock(domain, "a", lockTimeout)
 	require.Nil(err)
 	assert.True(res)
+
+	// locks are held per name
+	res, err = consulStore.Lock("example.net", "b", lockTimeout)
+	require.Nil(err)
+	assert.True(res)
+	err = consulStore.Release(domain, "b")
+	require.Nil(err)
+	res, err = consulStore.Lock(domain, "b", lockTimeout)
+	require.Nil(err)
+	assert.False(res)
 }
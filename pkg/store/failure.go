@@ -0,0 +1,20 @@
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrNotFoundFailure = errors.New("not found failure state")
+
+// FailureState is the renewal failure of a certificate.
+// It is kept in the store so that backoff survives restarts and is shared by every instance.
+type FailureState struct {
+	Count       int       `json:"count"`
+	LastError   string    `json:"last_error"`
+	LastAttempt time.Time `json:"last_attempt"`
+	NextAttempt time.Time `json:"next_attempt"`
+	RateLimited bool      `json:"rate_limited,omitempty"`
+	// ConfigHash identifies the config of the site which failed, empty for the states of earlier versions
+	ConfigHash string `json:"config_hash,omitempty"`
+}
@@ -31,11 +31,22 @@ func NewFileStore(base string) (*FileStore, error) {
 }
 
 func (f *FileStore) FetchUser(caServer string, userId string) (*store.Account, error) {
-	userPath, err := userFilePath(f.baseFilePath, caServer, userId)
+	userPath, err := userFilePath(f.baseFilePath, caServer, userId, false)
 	if err != nil {
 		return nil, err
 	}
+	return readUser(userPath)
+}
+
+func (f *FileStore) FetchLegacyUser(caServer string, userId string) (*store.Account, error) {
+	userPath, err := userFilePath(f.baseFilePath, caServer, userId, true)
+	if err != nil {
+		return nil, err
+	}
+	return readUser(userPath)
+}
 
+func readUser(userPath string) (*store.Account, error) {
 	fi, err := os.Open(userPath)
 	if errors.Is(err, os.ErrNotExist) {
 		return nil, store.ErrNotFoundUser
@@ -59,7 +70,7 @@ func (f *FileStore) FetchUser(caServer string, userId string) (*store.Account, e
 	return account, nil
 }
 func (f *FileStore) WriteUser(caServer string, account *store.Account) error {
-	userPath, err := userFilePath(f.baseFilePath, caServer, account.Email)
+	userPath, err := userFilePath(f.baseFilePath, caServer, account.Email, false)
 	if err != nil {
 		return err
 	}
@@ -114,8 +125,117 @@ func (f *FileStore) WriteResource(symbolicDomainName string, resource *store.Cer
 	return nil
 }
 
-func (f *FileStore) Lock(id string, timeout time.Duration) (bool, error) {
-	filePath := lockFilePath(f.baseFilePath)
+func (f *FileStore) FetchChallenge(challengeType string, token string) (*store.Challenge, error) {
+	challengePath := challengeFilePath(f.baseFilePath, challengeType, token)
+
+	content, err := ioutil.ReadFile(challengePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, store.ErrNotFoundChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := new(store.Challenge)
+	err = json.Unmarshal(content, challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	return challenge, nil
+}
+func (f *FileStore) ListChallenges(challengeType string) ([]*store.Challenge, error) {
+	paths, err := filepath.Glob(challengeFilePath(f.baseFilePath, challengeType, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	challenges := make([]*store.Challenge, 0, len(paths))
+	for _, challengePath := range paths {
+		content, err := ioutil.ReadFile(challengePath)
+		if errors.Is(err, os.ErrNotExist) {
+			// removed after glob
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		challenge := new(store.Challenge)
+		err = json.Unmarshal(content, challenge)
+		if err != nil {
+			return nil, err
+		}
+		challenges = append(challenges, challenge)
+	}
+
+	return challenges, nil
+}
+func (f *FileStore) WriteChallenge(challenge *store.Challenge) error {
+	challengePath := challengeFilePath(f.baseFilePath, challenge.Type, challenge.Token)
+	jsonBytes, err := json.MarshalIndent(challenge, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(challengePath, jsonBytes, 0700)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+func (f *FileStore) DeleteChallenge(challengeType string, token string) error {
+	challengePath := challengeFilePath(f.baseFilePath, challengeType, token)
+	err := os.Remove(challengePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) FetchFailure(symbolicDomainName string) (*store.FailureState, error) {
+	failurePath := failureFilePath(f.baseFilePath, symbolicDomainName)
+
+	content, err := ioutil.ReadFile(failurePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, store.ErrNotFoundFailure
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	failure := new(store.FailureState)
+	err = json.Unmarshal(content, failure)
+	if err != nil {
+		return nil, err
+	}
+
+	return failure, nil
+}
+func (f *FileStore) WriteFailure(symbolicDomainName string, failure *store.FailureState) error {
+	failurePath := failureFilePath(f.baseFilePath, symbolicDomainName)
+	jsonBytes, err := json.MarshalIndent(failure, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(failurePath, jsonBytes, 0700)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+func (f *FileStore) DeleteFailure(symbolicDomainName string) error {
+	failurePath := failureFilePath(f.baseFilePath, symbolicDomainName)
+	err := os.Remove(failurePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) Lock(name string, id string, timeout time.Duration) (bool, error) {
+	filePath := lockFilePath(f.baseFilePath, name)
 	lockFile, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0700)
 	if err != nil {
 		return false, err
@@ -152,8 +272,8 @@ func (f *FileStore) Lock(id string, timeout time.Duration) (bool, error) {
 
 	return true, nil
 }
-func (f *FileStore) Release(id string) error {
-	filePath := lockFilePath(f.baseFilePath)
+func (f *FileStore) Release(name string, id string) error {
+	filePath := lockFilePath(f.baseFilePath, name)
 	lockFile, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0700)
 	if err != nil {
 		return err
@@ -174,12 +294,18 @@ func (f *FileStore) Release(id string) error {
 	return nil
 }
 
-func userFilePath(base, caServer, userId string) (string, error) {
+// userFilePath returns the path of the account of the ca directory, keyed by the host and the path of the directory
+// because a ca can serve several directories with their own accounts. legacy returns the path keyed by the host only.
+func userFilePath(base, caServer, userId string, legacy bool) (string, error) {
 	serverUrl, err := url.Parse(caServer)
 	if err != nil {
 		return "", err
 	}
-	serverPath := strings.NewReplacer(":", "_", "/", "_").Replace(serverUrl.Host)
+	server := serverUrl.Host
+	if !legacy {
+		server += strings.TrimSuffix(serverUrl.Path, "/")
+	}
+	serverPath := strings.NewReplacer(":", "_", "/", "_").Replace(server)
 
 	return filepath.Join(base, fmt.Sprintf("user-%s-%s.json", serverPath, userId)), nil
 }
@@ -188,6 +314,14 @@ func resourceFilePath(base, domainName string) string {
 	return filepath.Join(base, fmt.Sprintf("resource-%s.json", domainName))
 }
 
-func lockFilePath(base string) string {
-	return filepath.Join(base, "leader")
+func challengeFilePath(base, challengeType, token string) string {
+	return filepath.Join(base, fmt.Sprintf("challenge-%s-%s.json", challengeType, token))
+}
+
+func failureFilePath(base, domainName string) string {
+	return filepath.Join(base, fmt.Sprintf("failure-%s.json", domainName))
+}
+
+func lockFilePath(base, name string) string {
+	return filepath.Join(base, fmt.Sprintf("lock-%s", name))
 }
@@ -4,6 +4,7 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"encoding/json"
 	"github.com/go-acme/lego/v4/certificate"
 	"github.com/kamijin-fanta/envoy-acme/pkg/store"
 	"github.com/stretchr/testify/assert"
@@ -43,6 +44,26 @@ func TestFileStore(t *testing.T) {
 	assert.Equal(email, account.Email)
 	assert.Equal(privateKey, account.GetPrivateKey())
 
+	// another directory of the same host has its own account
+	_, err = fileStore.FetchUser("https://acme-staging-v02.api.letsencrypt.org/other", email)
+	assert.Equal(store.ErrNotFoundUser, err)
+
+	// accounts written by earlier versions are keyed by the host, and only fetched explicitly
+	caDirectory := "https://ca.internal/acme/directory"
+	legacyPath, err := userFilePath(tmpDir, caDirectory, email, true)
+	require.Nil(err)
+	userBytes, err := json.Marshal(testAccount)
+	require.Nil(err)
+	require.Nil(ioutil.WriteFile(legacyPath, userBytes, 0600))
+	_, err = fileStore.FetchUser(caDirectory, email)
+	assert.Equal(store.ErrNotFoundUser, err)
+	_, err = fileStore.FetchUser("https://ca.internal/acme/other/directory", email)
+	assert.Equal(store.ErrNotFoundUser, err)
+	account, err = fileStore.FetchLegacyUser(caDirectory, email)
+	require.Nil(err)
+	assert.Equal(email, account.Email)
+	assert.Equal(privateKey, account.GetPrivateKey())
+
 	domain := "example.com"
 	testResource := store.NewStoreResource(&certificate.Resource{
 		Domain:            domain,
@@ -59,25 +80,79 @@ func TestFileStore(t *testing.T) {
 	response, err := fileStore.FetchResource(domain)
 	require.Nil(err)
 	require.NotNil(response)
-	assert.EqualValues(testResource, response.ToCertificateResource())
+	assert.Equal(testResource, response)
+	assert.Equal(testResource.ToCertificateResource(), response.ToCertificateResource())
+
+	testChallenge := &store.Challenge{
+		Type:    "http-01",
+		Domain:  domain,
+		Token:   "token",
+		KeyAuth: "token.thumbprint",
+	}
+	err = fileStore.WriteChallenge(testChallenge)
+	require.Nil(err)
+
+	challenge, err := fileStore.FetchChallenge("http-01", "token")
+	require.Nil(err)
+	assert.Equal(testChallenge, challenge)
+
+	challenges, err := fileStore.ListChallenges("http-01")
+	require.Nil(err)
+	assert.Equal([]*store.Challenge{testChallenge}, challenges)
+	challenges, err = fileStore.ListChallenges("tls-alpn-01")
+	require.Nil(err)
+	assert.Empty(challenges)
+
+	err = fileStore.DeleteChallenge("http-01", "token")
+	require.Nil(err)
+	_, err = fileStore.FetchChallenge("http-01", "token")
+	assert.Equal(store.ErrNotFoundChallenge, err)
+
+	testFailure := &store.FailureState{
+		Count:       2,
+		LastError:   "error",
+		LastAttempt: time.Now().UTC().Truncate(time.Second),
+		NextAttempt: time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+	}
+	err = fileStore.WriteFailure(domain, testFailure)
+	require.Nil(err)
+
+	failure, err := fileStore.FetchFailure(domain)
+	require.Nil(err)
+	assert.Equal(testFailure, failure)
+
+	err = fileStore.DeleteFailure(domain)
+	require.Nil(err)
+	_, err = fileStore.FetchFailure(domain)
+	assert.Equal(store.ErrNotFoundFailure, err)
 
 	lockTimeout := 100 * time.Millisecond
-	res, err := fileStore.Lock("a", lockTimeout)
+	res, err := fileStore.Lock(domain, "a", lockTimeout)
 	require.Nil(err)
 	assert.True(res)
-	res, err = fileStore.Lock("b", lockTimeout)
+	res, err = fileStore.Lock(domain, "b", lockTimeout)
 	require.Nil(err)
 	assert.False(res)
 	time.Sleep(lockTimeout)
-	res, err = fileStore.Lock("b", lockTimeout)
+	res, err = fileStore.Lock(domain, "b", lockTimeout)
 	require.Nil(err)
 	assert.True(res)
-	res, err = fileStore.Lock("a", lockTimeout)
+	res, err = fileStore.Lock(domain, "a", lockTimeout)
 	require.Nil(err)
 	assert.False(res)
-	err = fileStore.Release("b")
+	err = fileStore.Release(domain, "b")
+	require.Nil(err)
+	res, err = fileStore.Lock(domain, "a", lockTimeout)
 	require.Nil(err)
-	res, err = fileStore.Lock("a", lockTimeout)
+	assert.True(res)
+
+	// locks are held per name
+	res, err = fileStore.Lock("example.net", "b", lockTimeout)
 	require.Nil(err)
 	assert.True(res)
+	err = fileStore.Release(domain, "b")
+	require.Nil(err)
+	res, err = fileStore.Lock(domain, "b", lockTimeout)
+	require.Nil(err)
+	assert.False(res)
 }
@@ -10,24 +10,46 @@ import (
 
 type Store interface {
 	FetchUser(caServer string, userId string) (*Account, error)
+	// FetchLegacyUser returns the account stored by earlier versions, which is keyed by the host of the directory only.
+	FetchLegacyUser(caServer string, userId string) (*Account, error)
 	WriteUser(caServer string, account *Account) error
 	FetchResource(symbolicDomainName string) (*Certificates, error)
 	WriteResource(symbolicDomainName string, resource *Certificates) error
-	Lock(id string, timeout time.Duration) (bool, error)
-	Release(id string) error
+	FetchChallenge(challengeType string, token string) (*Challenge, error)
+	ListChallenges(challengeType string) ([]*Challenge, error)
+	WriteChallenge(challenge *Challenge) error
+	DeleteChallenge(challengeType string, token string) error
+	FetchFailure(symbolicDomainName string) (*FailureState, error)
+	WriteFailure(symbolicDomainName string, failure *FailureState) error
+	DeleteFailure(symbolicDomainName string) error
+	// Lock takes the lock of the certificate name for the instance id. false is returned while another instance holds it.
+	Lock(name string, id string, timeout time.Duration) (bool, error)
+	Release(name string, id string) error
 }
 
 var ErrNotFoundUser = errors.New("not found user")
 var ErrNotFoundCertificate = errors.New("not found certificate resource")
 
 type Certificates struct {
-	Domain            string `json:"domain"`
-	CertURL           string `json:"cert_url"`
-	CertStableURL     string `json:"cert_stable_url"`
-	PrivateKey        []byte `json:"private_key"`
-	Certificate       []byte `json:"certificate"`
-	IssuerCertificate []byte `json:"issuer_certificate"`
-	CSR               []byte `json:"csr"`
+	Domain             string     `json:"domain"`
+	CertURL            string     `json:"cert_url"`
+	CertStableURL      string     `json:"cert_stable_url"`
+	PrivateKey         []byte     `json:"private_key"`
+	Certificate        []byte     `json:"certificate"`
+	IssuerCertificate  []byte     `json:"issuer_certificate"`
+	CSR                []byte     `json:"csr"`
+	KeyType            string     `json:"key_type,omitempty"`
+	CaDir              string     `json:"ca_dir,omitempty"`
+	Profile            string     `json:"profile,omitempty"`
+	PreferredChain     string     `json:"preferred_chain,omitempty"`
+	ChainIssuer        string     `json:"chain_issuer,omitempty"`
+	OcspStaple         []byte     `json:"ocsp_staple,omitempty"`
+	KeyCreatedAt       *time.Time `json:"key_created_at,omitempty"`
+	NextPrivateKey     []byte     `json:"next_private_key,omitempty"`
+	NextKeyPublishedAt *time.Time `json:"next_key_published_at,omitempty"`
+	TlsaRecords        []string   `json:"tlsa_records,omitempty"`
+	// TlsaRetired are the published TLSA records of keys no longer used, with the time they are removed
+	TlsaRetired map[string]time.Time `json:"tlsa_retired,omitempty"`
 }
 
 func NewStoreResource(certificateResource *certificate.Resource) *Certificates {
@@ -54,6 +76,15 @@ func (c *Certificates) ToCertificateResource() *certificate.Resource {
 	}
 }
 
+// CertKeyType returns the key type the certificate was issued with.
+// Resources written before key types were recorded were always RSA 2048.
+func (c *Certificates) CertKeyType() string {
+	if c.KeyType == "" {
+		return "rsa2048"
+	}
+	return c.KeyType
+}
+
 func (c *Certificates) ExtractCertificate() ([]*x509.Certificate, error) {
 	return certcrypto.ParsePEMBundle(c.Certificate)
 }
@@ -0,0 +1,94 @@
+package xds_service
+
+import (
+	"context"
+	"github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"strconv"
+	"sync"
+)
+
+// servedSecrets tracks the tls-alpn-01 secrets acknowledged by Envoy, so that a challenge is
+// validated only after Envoy has applied the snapshot with its certificate.
+type servedSecrets struct {
+	mutex sync.Mutex
+	// keyAuths are the key authorizations of the published challenge secrets
+	keyAuths map[string]string
+	// published are the versions of the snapshots which published the current challenge secrets
+	published map[string]int64
+	// acked are the latest versions acknowledged for the secrets
+	acked map[string]int64
+	// changed is closed and replaced when a secret is acknowledged
+	changed chan struct{}
+}
+
+func newServedSecrets() *servedSecrets {
+	return &servedSecrets{
+		keyAuths:  map[string]string{},
+		published: map[string]int64{},
+		acked:     map[string]int64{},
+		changed:   make(chan struct{}),
+	}
+}
+
+// publish records the challenge secrets of the snapshot version.
+func (s *servedSecrets) publish(version int64, notification *common.Notification) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keyAuths := map[string]string{}
+	for _, chlg := range notification.Challenges {
+		name := TlsAlpn01SecretName(chlg.Domain)
+		keyAuths[name] = chlg.KeyAuth
+		if s.keyAuths[name] != chlg.KeyAuth {
+			s.published[name] = version
+		}
+	}
+	for name := range s.published {
+		if _, ok := keyAuths[name]; !ok {
+			delete(s.published, name)
+			delete(s.acked, name)
+		}
+	}
+	s.keyAuths = keyAuths
+}
+
+// ack records the version acknowledged by a request of Envoy. A request without a version or with an error
+// detail is the initial request or a rejection of the snapshot.
+func (s *servedSecrets) ack(req *envoy_service_discovery_v3.DiscoveryRequest) {
+	if req.GetVersionInfo() == "" || req.GetErrorDetail() != nil {
+		return
+	}
+	version, err := strconv.ParseInt(req.GetVersionInfo(), 10, 64)
+	if err != nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, name := range req.GetResourceNames() {
+		if _, ok := s.published[name]; ok && version > s.acked[name] {
+			s.acked[name] = version
+		}
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait returns when an Envoy has acknowledged the current challenge secret of the domain, or the context is done.
+func (s *servedSecrets) wait(ctx context.Context, domain string) error {
+	name := TlsAlpn01SecretName(domain)
+	for {
+		s.mutex.Lock()
+		published, ok := s.published[name]
+		served := ok && s.acked[name] >= published
+		changed := s.changed
+		s.mutex.Unlock()
+		if served {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
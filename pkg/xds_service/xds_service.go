@@ -6,10 +6,13 @@ import (
 	"fmt"
 	"github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	"github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	"github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
 	"github.com/kamijin-fanta/envoy-acme/pkg/common"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -17,6 +20,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
 	"net"
+	"strconv"
 	"time"
 )
 
@@ -29,15 +33,23 @@ var (
 
 type XdsService struct {
 	logger *logrus.Entry
+	served *servedSecrets
 }
 
 func NewXdsService(logger *logrus.Logger) *XdsService {
 	svc := &XdsService{
 		logger: logger.WithField("component", "xds_service"),
+		served: newServedSecrets(),
 	}
 	return svc
 }
 
+// WaitChallengeServed returns when an Envoy has applied the tls-alpn-01 challenge certificate of the domain,
+// or the context is done.
+func (x *XdsService) WaitChallengeServed(ctx context.Context, domain string) error {
+	return x.served.wait(ctx, domain)
+}
+
 var _ cache.NodeHash = &StandardNodeHash{}
 
 type StandardNodeHash struct{}
@@ -56,8 +68,11 @@ func (x *XdsService) RunServer(ctx context.Context, listener net.Listener, updat
 			xdsStreamOpenCounter.Inc()
 			return nil
 		},
-		StreamClosedFunc:   nil,
-		StreamRequestFunc:  nil,
+		StreamClosedFunc: nil,
+		StreamRequestFunc: func(i int64, req *envoy_service_discovery_v3.DiscoveryRequest) error {
+			x.served.ack(req)
+			return nil
+		},
 		StreamResponseFunc: nil,
 		FetchRequestFunc:   nil,
 		FetchResponseFunc:  nil,
@@ -68,7 +83,15 @@ func (x *XdsService) RunServer(ctx context.Context, listener net.Listener, updat
 	go func() {
 		for {
 			upstreams := <-update
-			err := snapshotCache.SetSnapshot("default", generateSnapshot(upstreams))
+			snapshot, err := generateSnapshot(upstreams)
+			if err != nil {
+				x.logger.WithError(err).Warn("error on generate snapshot")
+				continue
+			}
+			// recorded before it is sent, so that no acknowledgement is missed
+			version, _ := strconv.ParseInt(snapshot.GetVersion(resource.SecretType), 10, 64)
+			x.served.publish(version, upstreams)
+			err = snapshotCache.SetSnapshot("default", snapshot)
 			if err != nil {
 				panic(err)
 			}
@@ -82,29 +105,54 @@ func (x *XdsService) RunServer(ctx context.Context, listener net.Listener, updat
 	return grpcServer.Serve(listener)
 }
 
-func generateSnapshot(notification *common.Notification) cache.Snapshot {
+// TlsAlpn01SecretName returns the name of the temporary secret which holds the tls-alpn-01 challenge certificate for the domain.
+func TlsAlpn01SecretName(domain string) string {
+	return TlsAlpn01SecretPrefix + domain
+}
+
+const TlsAlpn01SecretPrefix = "tls-alpn-01/"
+
+func generateSnapshot(notification *common.Notification) (cache.Snapshot, error) {
 	var resources []types.Resource
 
-	for _, cert := range notification.Certificates {
-		secret := &envoy_extensions_transport_sockets_tls_v3.Secret{
-			Name: cert.Domain,
-			Type: &envoy_extensions_transport_sockets_tls_v3.Secret_TlsCertificate{
-				TlsCertificate: &envoy_extensions_transport_sockets_tls_v3.TlsCertificate{
-					CertificateChain: &envoy_config_core_v3.DataSource{
-						Specifier: &envoy_config_core_v3.DataSource_InlineBytes{
-							InlineBytes: cert.Certificate,
-						},
-					},
-					PrivateKey: &envoy_config_core_v3.DataSource{
-						Specifier: &envoy_config_core_v3.DataSource_InlineBytes{
-							InlineBytes: cert.PrivateKey,
-						},
-					},
+	for name, cert := range notification.Certificates {
+		secret := tlsCertificateSecret(name, cert.Certificate, cert.PrivateKey)
+		if len(cert.OcspStaple) != 0 {
+			secret.GetTlsCertificate().OcspStaple = &envoy_config_core_v3.DataSource{
+				Specifier: &envoy_config_core_v3.DataSource_InlineBytes{
+					InlineBytes: cert.OcspStaple,
 				},
-			},
+			}
 		}
 		resources = append(resources, secret)
 	}
+	for _, chlg := range notification.Challenges {
+		certPEM, keyPEM, err := tlsalpn01.ChallengeBlocks(chlg.Domain, chlg.KeyAuth)
+		if err != nil {
+			return cache.Snapshot{}, fmt.Errorf("error generate tls-alpn-01 certificate %w", err)
+		}
+		resources = append(resources, tlsCertificateSecret(TlsAlpn01SecretName(chlg.Domain), certPEM, keyPEM))
+	}
 
-	return cache.NewSnapshot(fmt.Sprintf("%d", time.Now().Unix()), nil, nil, nil, nil, nil, resources)
+	return cache.NewSnapshot(fmt.Sprintf("%d", time.Now().UnixNano()), nil, nil, nil, nil, nil, resources), nil
+}
+
+func tlsCertificateSecret(name string, certificateChain, privateKey []byte) *envoy_extensions_transport_sockets_tls_v3.Secret {
+	return &envoy_extensions_transport_sockets_tls_v3.Secret{
+		Name: name,
+		Type: &envoy_extensions_transport_sockets_tls_v3.Secret_TlsCertificate{
+			TlsCertificate: &envoy_extensions_transport_sockets_tls_v3.TlsCertificate{
+				CertificateChain: &envoy_config_core_v3.DataSource{
+					Specifier: &envoy_config_core_v3.DataSource_InlineBytes{
+						InlineBytes: certificateChain,
+					},
+				},
+				PrivateKey: &envoy_config_core_v3.DataSource{
+					Specifier: &envoy_config_core_v3.DataSource_InlineBytes{
+						InlineBytes: privateKey,
+					},
+				},
+			},
+		},
+	}
 }
@@ -0,0 +1,95 @@
+package xds_service
+
+import (
+	"context"
+	"github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/kamijin-fanta/envoy-acme/pkg/common"
+	"github.com/kamijin-fanta/envoy-acme/pkg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"testing"
+	"time"
+)
+
+func TestGenerateSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	snapshot, err := generateSnapshot(&common.Notification{
+		Certificates: map[string]*store.Certificates{
+			"example": {
+				Domain:      "example.com",
+				Certificate: []byte("certificate"),
+				PrivateKey:  []byte("private_key"),
+			},
+			"example-rsa": {
+				Domain:      "example.com",
+				Certificate: []byte("certificate"),
+				PrivateKey:  []byte("private_key"),
+				OcspStaple:  []byte("ocsp_staple"),
+			},
+		},
+		Challenges: []*store.Challenge{
+			{
+				Type:    "tls-alpn-01",
+				Domain:  "www.example.com",
+				Token:   "token",
+				KeyAuth: "token.thumbprint",
+			},
+		},
+	})
+	require.Nil(err)
+
+	secrets := snapshot.GetResources(resource.SecretType)
+	require.Len(secrets, 3)
+	assert.Contains(secrets, "example")
+	assert.Contains(secrets, "example-rsa")
+	require.Contains(secrets, "tls-alpn-01/www.example.com")
+
+	stapled := secrets["example-rsa"].(*envoy_extensions_transport_sockets_tls_v3.Secret)
+	assert.Equal([]byte("ocsp_staple"), stapled.GetTlsCertificate().GetOcspStaple().GetInlineBytes())
+	assert.Nil(secrets["example"].(*envoy_extensions_transport_sockets_tls_v3.Secret).GetTlsCertificate().GetOcspStaple())
+
+	secret := secrets["tls-alpn-01/www.example.com"].(*envoy_extensions_transport_sockets_tls_v3.Secret)
+	certPEM := secret.GetTlsCertificate().GetCertificateChain().GetInlineBytes()
+	cert, err := certcrypto.ParsePEMCertificate(certPEM)
+	require.Nil(err)
+	assert.Equal([]string{"www.example.com"}, cert.DNSNames)
+}
+
+func TestServedSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	served := newServedSecrets()
+	notification := &common.Notification{
+		Challenges: []*store.Challenge{{Type: "tls-alpn-01", Domain: "www.example.com", Token: "token", KeyAuth: "keyauth"}},
+	}
+	served.publish(2, notification)
+
+	waited := make(chan error, 1)
+	go func() {
+		waited <- served.wait(context.Background(), "www.example.com")
+	}()
+	names := []string{"tls-alpn-01/www.example.com"}
+	// the previous snapshot and a rejection of the snapshot do not serve the challenge
+	served.ack(&envoy_service_discovery_v3.DiscoveryRequest{VersionInfo: "1", ResourceNames: names})
+	served.ack(&envoy_service_discovery_v3.DiscoveryRequest{VersionInfo: "2", ResourceNames: names, ErrorDetail: &status.Status{Message: "invalid"}})
+	select {
+	case <-waited:
+		assert.Fail("served before the snapshot is acknowledged")
+	case <-time.After(100 * time.Millisecond):
+	}
+	served.ack(&envoy_service_discovery_v3.DiscoveryRequest{VersionInfo: "2", ResourceNames: names})
+	assert.Nil(<-waited)
+
+	// another challenge of the domain needs a new acknowledgement
+	notification.Challenges[0].KeyAuth = "keyauth-rsa"
+	served.publish(3, notification)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, served.wait(ctx, "www.example.com"))
+}